@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"superagent/control"
+	"superagent/meta"
+	"text/tabwriter"
+	"time"
+)
+
+// ctlCommands are the subcommands that act on a running meta agent through its control socket.
+var ctlCommands = map[string]bool{
+	"status":           true,
+	"list":             true,
+	"start":            true,
+	"stop":             true,
+	"restart":          true,
+	"effective-config": true,
+}
+
+// ctl runs a subcommand against the control socket of the running meta agent. It exits with 1 if it fails.
+func ctl(command string, args []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	var configPath, socketPath, output string
+	flags.StringVar(&configPath, "c", "/etc/newrelic/meta.yaml", "path of the meta agent config file, to find the control socket")
+	flags.StringVar(&socketPath, "s", "", "path of the control socket, instead of the one of the config file")
+	flags.StringVar(&output, "o", "text", "output format of status and list, text or json")
+	flags.Usage = func() {
+		usage := fmt.Sprintf("Usage: %s %s [flags]", os.Args[0], command)
+		if needsAgent(command) {
+			usage += " <agent>"
+		}
+		fmt.Fprintln(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if needsAgent(command) && flags.NArg() != 1 || !needsAgent(command) && flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if output != "text" && output != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown output format '%s'\n", output)
+		os.Exit(2)
+	}
+	if socketPath == "" {
+		config, err := meta.LoadConfig(configPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot find the control socket, use -s: %s\n", err)
+			os.Exit(1)
+		}
+		socketPath = meta.ControlSocketPath(config.DataDir)
+	}
+
+	client := control.NewClient(socketPath)
+	name := flags.Arg(0)
+	var err error
+	switch command {
+	case "status":
+		var status control.Status
+		if status, err = client.Status(); err == nil {
+			printStatus(status, output)
+		}
+	case "list":
+		var agents []control.AgentStatus
+		if agents, err = client.Agents(); err == nil {
+			printAgents(agents, output)
+		}
+	case "start":
+		if err = client.StartAgent(name); err == nil {
+			fmt.Printf("Agent '%s' started\n", name)
+		}
+	case "stop":
+		if err = client.StopAgent(name); err == nil {
+			fmt.Printf("Agent '%s' stopped\n", name)
+		}
+	case "restart":
+		if err = client.RestartAgent(name); err == nil {
+			fmt.Printf("Agent '%s' restarted\n", name)
+		}
+	case "effective-config":
+		var config string
+		if config, err = client.EffectiveConfig(name); err == nil {
+			fmt.Print(config)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func needsAgent(command string) bool {
+	return command != "status" && command != "list"
+}
+
+func printStatus(status control.Status, output string) {
+	if output == "json" {
+		printJSON(status)
+		return
+	}
+	health := "healthy"
+	if !status.Healthy {
+		health = "unhealthy"
+	}
+	fmt.Printf("Meta agent is %s, %d of %d agents running\n", health, status.RunningAgents, status.Agents)
+}
+
+func printAgents(agents []control.AgentStatus, output string) {
+	if output == "json" {
+		printJSON(agents)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tSTATE\tHEALTHY\tPID\tUPTIME\tRESTARTS\tLAST ERROR")
+	for _, agent := range agents {
+		uptime := "-"
+		if !agent.StartTime.IsZero() {
+			uptime = (time.Duration(agent.UptimeSeconds) * time.Second).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%d\t%s\t%d\t%s\n",
+			agent.Name, agent.Type, agent.State, agent.Healthy, agent.Pid, uptime, agent.Restarts, agent.LastError)
+	}
+	w.Flush()
+}
+
+func printJSON(v interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing the output %s\n", err)
+		os.Exit(2)
+	}
+}
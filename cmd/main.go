@@ -1,14 +1,25 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"superagent/meta"
+	"syscall"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		validate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && ctlCommands[os.Args[1]] {
+		ctl(os.Args[1], os.Args[2:])
+		return
+	}
+
 	var configPath string
 	flag.StringVar(&configPath, "c", "/etc/newrelic/meta.yaml", "path of the meta agent config file")
 	flag.Parse()
@@ -17,17 +28,25 @@ func main() {
 		fmt.Printf("Error starting the meta agent %s", err)
 		os.Exit(1)
 	}
-	err = metaAgent.Start()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go reloadOnHangup(metaAgent, configPath)
+
+	err = metaAgent.Run(ctx)
 	if err != nil {
-		fmt.Printf("Error starting the meta agent %s", err)
+		fmt.Printf("Error running the meta agent %s", err)
 		os.Exit(1)
 	}
+}
 
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
-	<-interrupt
-	err = metaAgent.Stop()
-	if err != nil {
-		fmt.Printf("Error shutting down meta agent %s", err)
+func reloadOnHangup(metaAgent *meta.MetaAgent, configPath string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		metaAgent.Logger().Infof("Reloading the meta agent config %s", configPath)
+		if err := metaAgent.Reload(); err != nil {
+			metaAgent.Logger().Errorf("Error reloading the meta agent config %s", err)
+		}
 	}
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"superagent/meta"
+)
+
+type validationReport struct {
+	Config   string              `json:"config"`
+	Valid    bool                `json:"valid"`
+	Problems []validationProblem `json:"problems"`
+}
+
+type validationProblem struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+	text    string
+}
+
+// validate checks a config file without starting any agent. It exits with 1 if any problem is found.
+func validate(args []string) {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	var configPath, output string
+	flags.StringVar(&configPath, "c", "/etc/newrelic/meta.yaml", "path of the meta agent config file")
+	flags.StringVar(&output, "o", "text", "output format, text or json")
+	flags.Parse(args)
+
+	problems := meta.Validate(configPath)
+	report := validationReport{Config: configPath, Valid: len(problems) == 0, Problems: []validationProblem{}}
+	for _, problem := range problems {
+		var configErr *meta.ConfigError
+		if errors.As(problem, &configErr) {
+			report.Problems = append(report.Problems, validationProblem{
+				File:    configErr.File,
+				Line:    configErr.Line,
+				Column:  configErr.Column,
+				Path:    configErr.Path,
+				Message: configErr.Message,
+				text:    problem.Error(),
+			})
+			continue
+		}
+		report.Problems = append(report.Problems, validationProblem{Message: problem.Error(), text: problem.Error()})
+	}
+
+	switch output {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing the report %s\n", err)
+			os.Exit(2)
+		}
+	case "text":
+		for _, problem := range report.Problems {
+			fmt.Println(problem.text)
+		}
+		if report.Valid {
+			fmt.Printf("%s: valid\n", configPath)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown output format '%s'\n", output)
+		os.Exit(2)
+	}
+
+	if !report.Valid {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,85 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// Client talks to the control socket of a running meta agent.
+type Client struct {
+	httpClient *http.Client
+}
+
+func NewClient(path string) *Client {
+	return &Client{httpClient: &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		},
+	}}
+}
+
+func (c *Client) Status() (Status, error) {
+	var status Status
+	err := c.do(http.MethodGet, "/v1/status", &status)
+	return status, err
+}
+
+func (c *Client) Agents() ([]AgentStatus, error) {
+	var agents []AgentStatus
+	err := c.do(http.MethodGet, "/v1/agents", &agents)
+	return agents, err
+}
+
+func (c *Client) StartAgent(name string) error {
+	return c.do(http.MethodPost, agentPath(name, "start"), nil)
+}
+
+func (c *Client) StopAgent(name string) error {
+	return c.do(http.MethodPost, agentPath(name, "stop"), nil)
+}
+
+func (c *Client) RestartAgent(name string) error {
+	return c.do(http.MethodPost, agentPath(name, "restart"), nil)
+}
+
+func (c *Client) EffectiveConfig(name string) (string, error) {
+	var config effectiveConfig
+	err := c.do(http.MethodGet, agentPath(name, "effective-config"), &config)
+	return config.Config, err
+}
+
+func agentPath(name string, action string) string {
+	return "/v1/agents/" + url.PathEscape(name) + "/" + action
+}
+
+func (c *Client) do(method string, path string, result interface{}) error {
+	req, err := http.NewRequest(method, "http://superagent"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var errResp errorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&errResp); err != nil || errResp.Error == "" {
+			return fmt.Errorf("unexpected response %s", resp.Status)
+		}
+		return errors.New(errResp.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
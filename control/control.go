@@ -0,0 +1,65 @@
+// Package control serves a small JSON API on a Unix domain socket, so operators can inspect and act on
+// a running meta agent. Only the peers running as root or as the user of the meta agent are allowed.
+package control
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrUnknownAgent    = errors.New("unknown agent")
+	ErrAgentRunning    = errors.New("agent is running")
+	ErrAgentNotRunning = errors.New("agent is not running")
+	ErrUnsupported     = errors.New("not supported by this agent type")
+)
+
+// Status is the overall state of the meta agent.
+type Status struct {
+	Healthy bool `json:"healthy"`
+	// Number of agents defined in the config, and of those running.
+	Agents        int `json:"agents"`
+	RunningAgents int `json:"runningAgents"`
+}
+
+// AgentStatus is the state of one agent.
+type AgentStatus struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Whether the meta agent is only ready when this agent is running.
+	Required      bool      `json:"required"`
+	Healthy       bool      `json:"healthy"`
+	State         string    `json:"state"`
+	LastError     string    `json:"lastError,omitempty"`
+	StartTime     time.Time `json:"startTime,omitempty"`
+	UptimeSeconds int64     `json:"uptimeSeconds"`
+	Pid           int       `json:"pid,omitempty"`
+	Restarts      int       `json:"restarts"`
+	LastExitCode  int       `json:"lastExitCode"`
+	// connected or disconnected, empty for the agents without an OpAMP connection.
+	OpampConnection string `json:"opampConnection,omitempty"`
+	// Hash of the last remote config applied, empty if none was.
+	ConfigHash string `json:"configHash,omitempty"`
+}
+
+// Ready tells whether every required agent is running and healthy.
+func Ready(agents []AgentStatus) bool {
+	for _, agent := range agents {
+		if agent.Required && (!agent.Healthy || agent.State != "running") {
+			return false
+		}
+	}
+	return true
+}
+
+// Controller is what the control socket acts on. The errors should wrap the errors of this package,
+// so the client gets a meaningful status code.
+type Controller interface {
+	Status() Status
+	Agents() []AgentStatus
+	StartAgent(name string) error
+	StopAgent(ctx context.Context, name string) error
+	RestartAgent(ctx context.Context, name string) error
+	EffectiveConfig(name string) (string, error)
+}
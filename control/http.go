@@ -0,0 +1,104 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"github.com/open-telemetry/opamp-go/client/types"
+	"io"
+	"net"
+	"net/http"
+)
+
+// HTTPServer serves the endpoints probed by container runtimes and process monitors:
+// /healthz answers as long as the meta agent does, /readyz only when every required agent is running
+// and healthy, and /agents returns the state of every agent. /metrics serves the metrics of the agents
+// in the Prometheus text format, when the controller is a MetricsWriter.
+type HTTPServer struct {
+	controller Controller
+	logger     types.Logger
+	server     *http.Server
+	listener   net.Listener
+}
+
+// MetricsWriter writes metrics in the Prometheus text format.
+type MetricsWriter interface {
+	WriteMetrics(w io.Writer) error
+}
+
+func NewHTTPServer(controller Controller, logger types.Logger) *HTTPServer {
+	s := &HTTPServer{controller: controller, logger: logger}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", s.handleHealthz)
+	mux.HandleFunc("/readyz", s.handleReadyz)
+	mux.HandleFunc("/agents", s.handleAgents)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	s.server = &http.Server{Handler: mux}
+	return s
+}
+
+// Listen binds address, so a busy port is reported before the agents are started.
+func (s *HTTPServer) Listen(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+	return nil
+}
+
+// Addr returns the address the server listens on.
+func (s *HTTPServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve serves the requests in the background.
+func (s *HTTPServer) Serve() {
+	go func() {
+		if err := s.server.Serve(s.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Errorf("HTTP server stopped: %s", err)
+		}
+	}()
+}
+
+func (s *HTTPServer) Close() error {
+	if s.listener == nil {
+		return nil
+	}
+	return s.server.Close()
+}
+
+type probeResponse struct {
+	Status string `json:"status"`
+}
+
+func (s *HTTPServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, probeResponse{Status: "ok"})
+}
+
+func (s *HTTPServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !Ready(s.controller.Agents()) {
+		writeJSON(w, http.StatusServiceUnavailable, probeResponse{Status: "not ready"})
+		return
+	}
+	writeJSON(w, http.StatusOK, probeResponse{Status: "ready"})
+}
+
+func (s *HTTPServer) handleAgents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.controller.Agents())
+}
+
+func (s *HTTPServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	writer, ok := s.controller.(MetricsWriter)
+	if !ok {
+		writeError(w, http.StatusNotFound, ErrUnsupported)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := writer.WriteMetrics(w); err != nil {
+		s.logger.Errorf("Cannot write the metrics: %s", err)
+	}
+}
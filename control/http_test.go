@@ -0,0 +1,86 @@
+package control
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+	"io"
+	"net/http"
+	"superagent/supervisor"
+	"testing"
+)
+
+func startTestHTTPServer(t *testing.T, controller Controller) string {
+	server := NewHTTPServer(controller, supervisor.NewLogger(zaptest.NewLogger(t)))
+	assert.Nil(t, server.Listen("127.0.0.1:0"))
+	server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return "http://" + server.Addr().String()
+}
+
+func get(t *testing.T, url string) int {
+	resp, err := http.Get(url)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestProbes(t *testing.T) {
+	controller := &fakeController{agents: []AgentStatus{
+		{Name: "gateway", Required: true, Healthy: true, State: "running"},
+		{Name: "helper", Required: false, Healthy: false, State: "backoff"},
+	}}
+	url := startTestHTTPServer(t, controller)
+
+	assert.Equal(t, http.StatusOK, get(t, url+"/healthz"))
+	// Agents that are not required do not prevent readiness.
+	assert.Equal(t, http.StatusOK, get(t, url+"/readyz"))
+
+	controller.agents[0].Healthy, controller.agents[0].State = false, "crash-looping"
+	assert.Equal(t, http.StatusServiceUnavailable, get(t, url+"/readyz"))
+	assert.Equal(t, http.StatusOK, get(t, url+"/healthz"))
+}
+
+func TestAgentsEndpoint(t *testing.T) {
+	controller := &fakeController{agents: []AgentStatus{
+		{Name: "gateway", Type: "otelcol", Required: true, Healthy: true, State: "running", Pid: 42, Restarts: 2,
+			UptimeSeconds: 60, LastExitCode: 1, OpampConnection: "connected", ConfigHash: "cafe"},
+	}}
+	url := startTestHTTPServer(t, controller)
+
+	resp, err := http.Get(url + "/agents")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	var agents []map[string]interface{}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&agents))
+	assert.Equal(t, 1, len(agents))
+	assert.Equal(t, float64(42), agents[0]["pid"])
+	assert.Equal(t, float64(60), agents[0]["uptimeSeconds"])
+	assert.Equal(t, float64(2), agents[0]["restarts"])
+	assert.Equal(t, float64(1), agents[0]["lastExitCode"])
+	assert.Equal(t, "connected", agents[0]["opampConnection"])
+	assert.Equal(t, "cafe", agents[0]["configHash"])
+}
+
+type metricsController struct {
+	*fakeController
+}
+
+func (c metricsController) WriteMetrics(w io.Writer) error {
+	_, err := io.WriteString(w, "superagent_agent_restarts_total{agent=\"gateway\",type=\"otelcol\"} 1\n")
+	return err
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	assert.Equal(t, http.StatusNotFound, get(t, startTestHTTPServer(t, &fakeController{})+"/metrics"))
+
+	url := startTestHTTPServer(t, metricsController{&fakeController{}})
+	resp, err := http.Get(url + "/metrics")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+	assert.Contains(t, string(body), "superagent_agent_restarts_total")
+}
@@ -0,0 +1,176 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/open-telemetry/opamp-go/client/types"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+type peerKey struct{}
+
+// peer is the process at the other end of a connection to the socket.
+type peer struct {
+	uid int
+	err error
+}
+
+type Server struct {
+	path       string
+	controller Controller
+	logger     types.Logger
+	server     *http.Server
+}
+
+func NewServer(path string, controller Controller, logger types.Logger) *Server {
+	s := &Server{path: path, controller: controller, logger: logger}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/status", s.handleStatus)
+	mux.HandleFunc("/v1/agents", s.handleAgents)
+	mux.HandleFunc("/v1/agents/", s.handleAgent)
+	s.server = &http.Server{
+		Handler: s.authorize(mux),
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			uid, err := peerUid(conn)
+			return context.WithValue(ctx, peerKey{}, peer{uid: uid, err: err})
+		},
+	}
+	return s
+}
+
+// Start listens on the socket, replacing the one a previous meta agent may have left, and serves
+// the requests in the background.
+func (s *Server) Start() error {
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	listener, err := net.Listen("unix", s.path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(s.path, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Errorf("Control socket stopped: %s", err)
+		}
+	}()
+	return nil
+}
+
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// authorize only lets through the peers running as root or as the user of the meta agent.
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := r.Context().Value(peerKey{}).(peer)
+		if p.err != nil {
+			s.logger.Errorf("Cannot get the credentials of a control socket peer: %s", p.err)
+			writeError(w, http.StatusForbidden, errors.New("cannot get peer credentials"))
+			return
+		}
+		if p.uid != 0 && p.uid != os.Getuid() {
+			writeError(w, http.StatusForbidden, fmt.Errorf("user %d is not allowed", p.uid))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.controller.Status())
+}
+
+func (s *Server) handleAgents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.controller.Agents())
+}
+
+// handleAgent serves /v1/agents/<name>/<action>.
+func (s *Server) handleAgent(w http.ResponseWriter, r *http.Request) {
+	name, action, found := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/agents/"), "/")
+	if !found || name == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such endpoint %s", r.URL.Path))
+		return
+	}
+
+	method := http.MethodPost
+	if action == "effective-config" {
+		method = http.MethodGet
+	}
+	if r.Method != method {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	var err error
+	switch action {
+	case "start":
+		err = s.controller.StartAgent(name)
+	case "stop":
+		s.logger.Debugf("Stopping agent %s from the control socket", name)
+		err = s.controller.StopAgent(r.Context(), name)
+	case "restart":
+		s.logger.Debugf("Restarting agent %s from the control socket", name)
+		err = s.controller.RestartAgent(r.Context(), name)
+	case "effective-config":
+		var config string
+		config, err = s.controller.EffectiveConfig(name)
+		if err == nil {
+			writeJSON(w, http.StatusOK, effectiveConfig{Config: config})
+			return
+		}
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such endpoint %s", r.URL.Path))
+		return
+	}
+	if err != nil {
+		writeError(w, statusCode(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type effectiveConfig struct {
+	Config string `json:"config"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func statusCode(err error) int {
+	switch {
+	case errors.Is(err, ErrUnknownAgent):
+		return http.StatusNotFound
+	case errors.Is(err, ErrAgentRunning), errors.Is(err, ErrAgentNotRunning), errors.Is(err, ErrUnsupported):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
@@ -0,0 +1,141 @@
+package control
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+	"net"
+	"os"
+	"path/filepath"
+	"superagent/supervisor"
+	"testing"
+)
+
+type fakeController struct {
+	running map[string]bool
+	agents  []AgentStatus
+}
+
+func (c *fakeController) Status() Status {
+	return Status{Healthy: true, Agents: len(c.running), RunningAgents: 1}
+}
+
+func (c *fakeController) Agents() []AgentStatus {
+	return c.agents
+}
+
+func (c *fakeController) agent(name string) (bool, error) {
+	running, found := c.running[name]
+	if !found {
+		return false, fmt.Errorf("agent '%s': %w", name, ErrUnknownAgent)
+	}
+	return running, nil
+}
+
+func (c *fakeController) StartAgent(name string) error {
+	running, err := c.agent(name)
+	if err != nil {
+		return err
+	}
+	if running {
+		return fmt.Errorf("cannot start agent '%s': %w", name, ErrAgentRunning)
+	}
+	c.running[name] = true
+	return nil
+}
+
+func (c *fakeController) StopAgent(ctx context.Context, name string) error {
+	if _, err := c.agent(name); err != nil {
+		return err
+	}
+	c.running[name] = false
+	return nil
+}
+
+func (c *fakeController) RestartAgent(ctx context.Context, name string) error {
+	if _, err := c.agent(name); err != nil {
+		return err
+	}
+	c.running[name] = true
+	return nil
+}
+
+func (c *fakeController) EffectiveConfig(name string) (string, error) {
+	if _, err := c.agent(name); err != nil {
+		return "", err
+	}
+	return "receivers: {}\n", nil
+}
+
+func startTestServer(t *testing.T, controller Controller) string {
+	path := filepath.Join(t.TempDir(), "superagent.sock")
+	server := NewServer(path, controller, supervisor.NewLogger(zaptest.NewLogger(t)))
+	assert.Nil(t, server.Start())
+	t.Cleanup(func() { server.Close() })
+	return path
+}
+
+func TestControlSocket(t *testing.T) {
+	controller := &fakeController{
+		running: map[string]bool{"a": true, "b": false},
+		agents:  []AgentStatus{{Name: "a", Type: "process", Healthy: true, State: "running"}},
+	}
+	path := startTestServer(t, controller)
+
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	client := NewClient(path)
+	status, err := client.Status()
+	assert.Nil(t, err)
+	assert.Equal(t, Status{Healthy: true, Agents: 2, RunningAgents: 1}, status)
+
+	agents, err := client.Agents()
+	assert.Nil(t, err)
+	assert.Equal(t, []AgentStatus{{Name: "a", Type: "process", Healthy: true, State: "running"}}, agents)
+
+	assert.Nil(t, client.StartAgent("b"))
+	assert.True(t, controller.running["b"])
+	assert.EqualError(t, client.StartAgent("b"), "cannot start agent 'b': agent is running")
+	assert.Nil(t, client.StopAgent("a"))
+	assert.False(t, controller.running["a"])
+	assert.Nil(t, client.RestartAgent("a"))
+	assert.True(t, controller.running["a"])
+
+	config, err := client.EffectiveConfig("a")
+	assert.Nil(t, err)
+	assert.Equal(t, "receivers: {}\n", config)
+	_, err = client.EffectiveConfig("unknown")
+	assert.EqualError(t, err, "agent 'unknown': unknown agent")
+}
+
+func TestControlSocketReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "superagent.sock")
+	assert.Nil(t, os.WriteFile(path, nil, 0600))
+	server := NewServer(path, &fakeController{}, supervisor.NewLogger(zaptest.NewLogger(t)))
+	assert.Nil(t, server.Start())
+	defer server.Close()
+
+	_, err := NewClient(path).Status()
+	assert.Nil(t, err)
+}
+
+func TestPeerUid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peer.sock")
+	listener, err := net.Listen("unix", path)
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	conn, err := net.Dial("unix", path)
+	assert.Nil(t, err)
+	defer conn.Close()
+	accepted, err := listener.Accept()
+	assert.Nil(t, err)
+	defer accepted.Close()
+
+	uid, err := peerUid(accepted)
+	assert.Nil(t, err)
+	assert.Equal(t, os.Getuid(), uid)
+}
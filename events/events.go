@@ -0,0 +1,96 @@
+// Package events carries what happens inside the supervisors to the parts of the meta agent, or of the
+// programs embedding it, that want to know.
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Type string
+
+const (
+	AgentStarted         Type = "agent-started"
+	AgentExited          Type = "agent-exited"
+	RestartScheduled     Type = "restart-scheduled"
+	CrashLoopDetected    Type = "crash-loop-detected"
+	RemoteConfigReceived Type = "remote-config-received"
+	RemoteConfigApplied  Type = "remote-config-applied"
+	RemoteConfigRejected Type = "remote-config-rejected"
+	OpampConnected       Type = "opamp-connected"
+	OpampDisconnected    Type = "opamp-disconnected"
+)
+
+// Event is something that happened to an agent.
+type Event struct {
+	Type  Type
+	Agent string
+	Time  time.Time
+	// What is known about the event, such as "pid", "exitCode", "delay", "hash" or "error".
+	Details map[string]string
+}
+
+// Bus delivers the published events to every subscriber. A nil Bus drops the events, so publishers do not
+// need to check whether anybody listens.
+type Bus struct {
+	mu          sync.Mutex
+	subscribers map[*Subscription]struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{subscribers: make(map[*Subscription]struct{})}
+}
+
+// Subscribe returns a subscription whose channel buffers up to buffer events. The events published while
+// the buffer is full are dropped for this subscriber only, so a slow consumer never blocks a supervisor.
+func (b *Bus) Subscribe(buffer int) *Subscription {
+	s := &Subscription{bus: b, ch: make(chan Event, buffer)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[s] = struct{}{}
+	return s
+}
+
+// Publish sends event to the subscribers without waiting for them.
+func (b *Bus) Publish(event Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subscribers {
+		select {
+		case s.ch <- event:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// Subscription receives the events published on a Bus until it is closed.
+type Subscription struct {
+	bus     *Bus
+	ch      chan Event
+	dropped atomic.Uint64
+}
+
+// Events returns the channel of the events, closed by Close.
+func (s *Subscription) Events() <-chan Event {
+	return s.ch
+}
+
+// Dropped returns the number of events lost because the buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close stops the delivery of the events and closes the channel.
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if _, found := s.bus.subscribers[s]; found {
+		delete(s.bus.subscribers, s)
+		close(s.ch)
+	}
+}
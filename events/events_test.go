@@ -0,0 +1,36 @@
+package events
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBus(t *testing.T) {
+	bus := NewBus()
+	fast := bus.Subscribe(10)
+	slow := bus.Subscribe(1)
+
+	bus.Publish(Event{Type: AgentStarted, Agent: "a"})
+	bus.Publish(Event{Type: AgentExited, Agent: "a", Details: map[string]string{"exitCode": "1"}})
+
+	assert.Equal(t, AgentStarted, (<-fast.Events()).Type)
+	assert.Equal(t, "1", (<-fast.Events()).Details["exitCode"])
+	assert.Equal(t, uint64(0), fast.Dropped())
+	// The full buffer of a slow subscriber does not hold the others back.
+	assert.Equal(t, AgentStarted, (<-slow.Events()).Type)
+	assert.Equal(t, uint64(1), slow.Dropped())
+
+	slow.Close()
+	slow.Close()
+	_, open := <-slow.Events()
+	assert.False(t, open)
+	bus.Publish(Event{Type: AgentStarted, Agent: "b"})
+	assert.Equal(t, "b", (<-fast.Events()).Agent)
+}
+
+func TestNilBus(t *testing.T) {
+	var bus *Bus
+	assert.NotPanics(t, func() {
+		bus.Publish(Event{Type: AgentStarted})
+	})
+}
@@ -8,6 +8,7 @@ require (
 	github.com/open-telemetry/opamp-go v0.7.0
 	github.com/stretchr/testify v1.7.0
 	go.uber.org/zap v1.17.0
+	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 	gopkg.in/yaml.v3 v3.0.1
 )
 
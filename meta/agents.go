@@ -0,0 +1,86 @@
+package meta
+
+import (
+	"github.com/oklog/ulid/v2"
+	"superagent/otelcol"
+	"superagent/process"
+)
+
+func init() {
+	RegisterAgentType("otelcol", newOtelCol)
+	RegisterAgentType("nrdot", newNrDot)
+	RegisterAgentType("process", newProcess)
+}
+
+// opampSettings returns the OpAMP settings of an agent, which default to the global ones.
+func opampSettings(block *AgentBlock, globals Globals) (opampUrl string, apiKey string, headers map[string]string) {
+	opampUrl, apiKey = globals.OpampUrl, globals.ApiKey
+	if s := block.OptionalString("opampUrl"); s != "" {
+		opampUrl = s
+	}
+	if s := block.OptionalString("apiKey"); s != "" {
+		apiKey = s
+	}
+	return opampUrl, apiKey, block.StringMap("headers")
+}
+
+// instanceId returns the instance id an agent is pinned to, zero if it is not.
+func instanceId(block *AgentBlock) ulid.ULID {
+	s := block.OptionalString("instanceId")
+	if s == "" {
+		return ulid.ULID{}
+	}
+	id, err := ulid.ParseStrict(s)
+	if err != nil {
+		block.Errorf("instanceId", "Invalid instance id '%s'", s)
+	}
+	return id
+}
+
+func newOtelCol(block *AgentBlock, globals Globals) (Agent, error) {
+	exec := block.String("executable")
+	opampUrl, apiKey, headers := opampSettings(block, globals)
+	restartPolicy := block.RestartPolicy()
+	args, env, workingDir := block.StringList("args"), block.Env("env"), block.OptionalString("workingDir")
+	pinnedId := instanceId(block)
+	if err := block.Err(); err != nil {
+		return nil, err
+	}
+	agent := otelcol.NewOtelCol(block.Name(), block.DataDir(globals), block.LogDir(globals), globals.LogRotation, restartPolicy, exec, opampUrl, apiKey)
+	agent.Headers, agent.Args, agent.Env, agent.WorkingDir = headers, args, env, workingDir
+	agent.InstanceId = pinnedId
+	return agent, nil
+}
+
+func newNrDot(block *AgentBlock, globals Globals) (Agent, error) {
+	exec := block.String("executable")
+	opampUrl, apiKey, headers := opampSettings(block, globals)
+	restartPolicy := block.RestartPolicy()
+	args, env, workingDir := block.StringList("args"), block.Env("env"), block.OptionalString("workingDir")
+	pinnedId := instanceId(block)
+	if err := block.Err(); err != nil {
+		return nil, err
+	}
+	agent := otelcol.NewNrDot(block.Name(), block.DataDir(globals), block.LogDir(globals), globals.LogRotation, restartPolicy, exec, opampUrl, apiKey)
+	agent.Headers, agent.Args, agent.Env, agent.WorkingDir = headers, args, env, workingDir
+	agent.InstanceId = pinnedId
+	return agent, nil
+}
+
+func newProcess(block *AgentBlock, globals Globals) (Agent, error) {
+	p := &process.Process{
+		Name:          block.Name(),
+		DataDir:       block.DataDir(globals),
+		LogDir:        block.LogDir(globals),
+		LogRotation:   globals.LogRotation,
+		RestartPolicy: block.RestartPolicy(),
+		Executable:    block.String("executable"),
+		Args:          block.StringList("args"),
+		Env:           block.Env("env"),
+		WorkingDir:    block.OptionalString("workingDir"),
+	}
+	if err := block.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -1,21 +1,36 @@
 package meta
 
 import (
-	"fmt"
-	"github.com/knadh/koanf"
-	"github.com/knadh/koanf/providers/file"
+	"errors"
 	"gopkg.in/yaml.v3"
+	"os"
 	"path/filepath"
-	"superagent/otelcol"
+	"strings"
 	"superagent/supervisor"
+	"time"
 )
 
 type Meta struct {
-	ApiKey   string
-	OpampUrl string
-	DataDir  string
-	LogDir   string
-	Agents   []Agent
+	ApiKey      string
+	OpampUrl    string
+	DataDir     string
+	LogDir      string
+	LogRotation supervisor.LogRotation
+	// What to do when some agents cannot be started, all-or-nothing by default.
+	StartupPolicy StartupPolicy
+	// How many agents are started or stopped at the same time.
+	MaxConcurrency int
+	// How long stopping every agent may take before the ones left are killed.
+	ShutdownTimeout time.Duration
+	Agents          []Agent
+	// Names of the agents each agent depends on, by agent name.
+	DependsOn map[string][]string
+	// Whether the meta agent is only ready when the agent is running, by agent name. True by default.
+	Required map[string]bool
+	// Address of the HTTP listener of the health and readiness endpoints, empty if disabled.
+	HTTPAddress string
+	// Level and encoding of the logs of the meta agent, info and console by default.
+	Logging supervisor.LogConfig
 }
 
 type Agent interface {
@@ -24,18 +39,83 @@ type Agent interface {
 	GetSupervisor() supervisor.Supervisor
 }
 
+// withDefaults returns meta with the settings it leaves unset given their default value, as LoadConfig
+// does, for a config that is not loaded from a file.
+func withDefaults(meta Meta) Meta {
+	if meta.StartupPolicy == "" {
+		meta.StartupPolicy = StartupAllOrNothing
+	}
+	if meta.MaxConcurrency <= 0 {
+		meta.MaxConcurrency = DefaultMaxConcurrency
+	}
+	if meta.ShutdownTimeout <= 0 {
+		meta.ShutdownTimeout = DefaultShutdownTimeout
+	}
+	// Agents are required unless told otherwise.
+	required := make(map[string]bool)
+	for _, agent := range meta.Agents {
+		required[agent.GetName()] = true
+	}
+	for name, r := range meta.Required {
+		required[name] = r
+	}
+	meta.Required = required
+	return meta
+}
+
+// LoadConfig loads the config file at path, along with the drop-in fragments of its .d directory.
+// The error, if any, joins every problem found in the files, each of them a *ConfigError.
 func LoadConfig(path string) (*Meta, error) {
-	k := koanf.New("::")
-	if err := k.Load(file.Provider(path), Parser()); err != nil {
-		return nil, err
+	config, errs := loadConfig(path)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
 	}
+	return config.meta, nil
+}
+
+// parsedConfig is a parsed config, with the values the settings were taken from and the definition each agent
+// was built from.
+type parsedConfig struct {
+	meta     *Meta
+	settings map[string]value
+	blocks   map[string]*AgentBlock
+	// Paths of the files the config was parsed from, in order.
+	files []string
+}
+
+// configFile is the content of the main config file or of one of its drop-in fragments.
+type configFile struct {
+	path    string
+	content []byte
+}
+
+// DropInDir returns the directory of the drop-in fragments of the config file at path: meta.d for meta.yaml.
+// Each *.yaml file in it adds agents and may override the global settings, in lexical order.
+func DropInDir(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".d"
+}
 
-	meta := &Meta{}
-	if err := k.Unmarshal("", meta); err != nil {
-		return nil, fmt.Errorf("cannot parse %v: %w", path, err)
+// loadConfig loads the config file at path and its drop-in fragments, and returns every problem found in them.
+func loadConfig(path string) (*parsedConfig, []error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, []error{err}
 	}
+	files := []configFile{{path: path, content: b}}
 
-	return meta, nil
+	// Glob returns the files in lexical order.
+	fragments, err := filepath.Glob(filepath.Join(DropInDir(path), "*.yaml"))
+	if err != nil {
+		return nil, []error{err}
+	}
+	for _, fragment := range fragments {
+		b, err := os.ReadFile(fragment)
+		if err != nil {
+			return nil, []error{err}
+		}
+		files = append(files, configFile{path: fragment, content: b})
+	}
+	return parse(files...)
 }
 
 // implements a koanf parser.
@@ -46,93 +126,325 @@ func Parser() *MetaParser {
 }
 
 func (p *MetaParser) Unmarshal(b []byte) (map[string]interface{}, error) {
-	var firstPass map[string]interface{}
-	if err := yaml.Unmarshal(b, &firstPass); err != nil {
-		return nil, err
-	}
-	secondPass := make(map[string]interface{})
-	agents := make([]Agent, 0)
-	seenAgents := make(map[string]string)
-	dataDir, found := firstPass["dataDir"]
-	if !found {
-		return nil, fmt.Errorf("No dataDir defined")
+	config, errs := parse(configFile{content: b})
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
 	}
-	logDir, found := firstPass["logDir"]
-	if !found {
-		return nil, fmt.Errorf("No logDir defined")
+	return map[string]interface{}{
+		"apiKey":      config.meta.ApiKey,
+		"opampUrl":    config.meta.OpampUrl,
+		"dataDir":     config.meta.DataDir,
+		"logDir":      config.meta.LogDir,
+		"logRotation": config.meta.LogRotation,
+		"agents":      config.meta.Agents,
+	}, nil
+}
+
+func (p *MetaParser) Marshal(o map[string]interface{}) ([]byte, error) {
+	return yaml.Marshal(o)
+}
+
+// parseRoot parses the top level map of a config file, or returns nil if it has none. A fragment may be empty.
+func parseRoot(d *decoder, file configFile, fragment bool) *mapping {
+	var document yaml.Node
+	if err := yaml.Unmarshal(file.content, &document); err != nil {
+		d.errs = append(d.errs, &ConfigError{File: file.path, Message: err.Error()})
+		return nil
 	}
-	opampUrl, found := firstPass["opampUrl"]
-	if !found {
-		return nil, fmt.Errorf("No opampUrl defined")
+	if len(document.Content) == 0 {
+		if !fragment {
+			d.errs = append(d.errs, &ConfigError{File: file.path, Message: "Config is empty"})
+		}
+		return nil
 	}
-	apiKey, found := firstPass["apiKey"]
-	if !found {
-		return nil, fmt.Errorf("No apiKey defined")
-	}
-	for k, v := range firstPass {
-		switch k {
-		case "apiKey", "dataDir", "logDir", "opampUrl":
-			secondPass[k] = v
-		case "agents":
-			for _, a := range firstPass[k].([]interface{}) {
-				parsedAgent, err := parseAgent(a, dataDir.(string), logDir.(string), opampUrl.(string), apiKey.(string))
+	root, _ := newValue(d, document.Content[0], "").Mapping()
+	return root
+}
+
+// parse goes through the main config file and its fragments, and returns what could be parsed along with
+// every problem found, not only the first one. The settings of a fragment override those of the files
+// before it.
+func parse(files ...configFile) (*parsedConfig, []error) {
+	decoders := make([]*decoder, 0, len(files))
+	roots := make([]*mapping, 0, len(files))
+	for i, file := range files {
+		d := &decoder{file: file.path}
+		root := parseRoot(d, file, i > 0)
+		if i == 0 && root == nil {
+			return nil, d.errs
+		}
+		decoders = append(decoders, d)
+		if root != nil {
+			roots = append(roots, root)
+		}
+	}
+
+	config := &parsedConfig{meta: &Meta{Agents: make([]Agent, 0), Required: make(map[string]bool)}, settings: make(map[string]value), blocks: make(map[string]*AgentBlock)}
+	for _, file := range files {
+		config.files = append(config.files, file.path)
+	}
+	meta := config.meta
+	for _, setting := range []struct {
+		key    string
+		target *string
+	}{
+		{"dataDir", &meta.DataDir},
+		{"logDir", &meta.LogDir},
+		{"opampUrl", &meta.OpampUrl},
+		{"apiKey", &meta.ApiKey},
+	} {
+		for _, root := range roots {
+			if v, found := root.Get(setting.key); found {
+				config.settings[setting.key] = v
+				*setting.target, _ = v.String()
+			}
+		}
+		if _, found := config.settings[setting.key]; !found {
+			roots[0].d.errorf(roots[0].node, setting.key, "No %s defined", setting.key)
+		}
+	}
+	meta.LogRotation = supervisor.DefaultLogRotation()
+	for _, root := range roots {
+		if v, found := root.Get("logRotation"); found {
+			meta.LogRotation = parseLogRotation(v, meta.LogRotation)
+		}
+	}
+	meta.StartupPolicy = StartupAllOrNothing
+	for _, root := range roots {
+		if v, found := root.Get("startupPolicy"); found {
+			if rawPolicy, ok := v.String(); ok {
+				policy, err := ParseStartupPolicy(rawPolicy)
 				if err != nil {
-					return nil, err
+					v.errorf("Unknown startup policy '%s'", v.Raw())
 				}
-				_, found := seenAgents[parsedAgent.GetName()]
-				if found {
-					return nil, fmt.Errorf("Agent '%s' defined multiple times", parsedAgent.GetName())
+				meta.StartupPolicy = policy
+			}
+		}
+	}
+	for _, root := range roots {
+		if v, found := root.Get("http"); found {
+			meta.HTTPAddress = parseHTTP(v, meta.HTTPAddress)
+		}
+	}
+	meta.Logging = supervisor.DefaultLogConfig()
+	for _, root := range roots {
+		if v, found := root.Get("logging"); found {
+			meta.Logging = parseLogging(v, meta.Logging)
+		}
+	}
+	meta.MaxConcurrency = DefaultMaxConcurrency
+	meta.ShutdownTimeout = DefaultShutdownTimeout
+	for _, root := range roots {
+		if v, found := root.Get("maxConcurrency"); found {
+			if maxConcurrency, ok := v.Int(); ok {
+				if maxConcurrency < 1 {
+					v.errorf("must be at least 1")
+				}
+				meta.MaxConcurrency = maxConcurrency
+			}
+		}
+		if v, found := root.Get("shutdownTimeout"); found {
+			if timeout, ok := v.Duration(); ok {
+				if timeout <= 0 {
+					v.errorf("must be positive")
 				}
-				seenAgents[parsedAgent.GetName()] = ""
-				agents = append(agents, parsedAgent)
+				meta.ShutdownTimeout = timeout
 			}
-			secondPass[k] = agents
-		default:
-			return nil, fmt.Errorf("Unknown parameter '%s'", k)
 		}
 	}
-	return secondPass, nil
+	globals := Globals{
+		ApiKey:      meta.ApiKey,
+		OpampUrl:    meta.OpampUrl,
+		DataDir:     meta.DataDir,
+		LogDir:      meta.LogDir,
+		LogRotation: meta.LogRotation,
+	}
+
+	for _, root := range roots {
+		v, found := root.Get("agents")
+		if !found {
+			continue
+		}
+		items, _ := v.Sequence()
+		for _, item := range items {
+			block, parsedAgent := parseAgent(item, globals)
+			if parsedAgent == nil {
+				continue
+			}
+			if first, found := config.blocks[parsedAgent.GetName()]; found {
+				if first.fields.d.file != block.fields.d.file {
+					firstName := first.nameValue
+					block.Errorf("name", "Agent '%s' defined multiple times, first in %s:%d:%d",
+						block.nameValue.Raw(), firstName.d.file, firstName.node.Line, firstName.node.Column)
+				} else {
+					block.Errorf("name", "Agent '%s' defined multiple times", block.nameValue.Raw())
+				}
+				continue
+			}
+			config.blocks[parsedAgent.GetName()] = block
+			meta.Agents = append(meta.Agents, parsedAgent)
+			meta.Required[parsedAgent.GetName()] = block.required
+		}
+	}
+	meta.DependsOn = checkDependencies(meta.Agents, config.blocks)
+
+	for _, root := range roots {
+		root.CheckUnknown()
+	}
+	var errs []error
+	for _, d := range decoders {
+		errs = append(errs, d.errs...)
+	}
+	sortErrors(errs, config.files)
+	return config, errs
 }
 
-func parseAgent(in interface{}, baseDataDir string, baseLogDir string, opampUrl string, apiKey string) (Agent, error) {
-	config := in.(map[string]interface{})
-	agentName, found := findString(config, "name")
+// parseAgent builds an agent with the factory of its type. It returns a nil Agent if the definition has problems,
+// which are reported to the decoder.
+func parseAgent(v value, globals Globals) (*AgentBlock, Agent) {
+	fields, ok := v.Mapping()
+	if !ok {
+		return nil, nil
+	}
+	nameValue, found := fields.Require("name", "No name defined for agent")
 	if !found {
-		return nil, fmt.Errorf("No name defined for agent")
+		return nil, nil
 	}
-
-	agentType, found := findString(config, "type")
+	block := &AgentBlock{fields: fields, nameValue: nameValue}
+	if block.name, ok = nameValue.String(); !ok {
+		return nil, nil
+	}
+	typeValue, found := fields.Require("type", "Undefined type for agent '%s'", nameValue.Raw())
 	if !found {
-		return nil, fmt.Errorf("Undefined type for agent '%s'", config["name"].(string))
+		return nil, nil
 	}
-	dataDir := filepath.Join(baseDataDir, agentType, agentName)
-	logDir := filepath.Join(baseLogDir, agentType, agentName)
-	switch agentType {
-	case "otelcol":
-		exec, found := config["executable"]
-		if !found {
-			return nil, fmt.Errorf("No executable defined")
+	if block.agentType, ok = typeValue.String(); !ok {
+		return nil, nil
+	}
+	factory, found := getAgentFactory(block.agentType)
+	if !found {
+		typeValue.errorf("Unknown agent type '%s'", typeValue.Raw())
+		return nil, nil
+	}
+
+	if v, found := fields.Get("dependsOn"); found {
+		block.dependsOn, _ = v.Sequence()
+	}
+	block.required = true
+	if v, found := fields.Get("required"); found {
+		block.required, _ = v.Bool()
+	}
+
+	errCount := len(v.d.errs)
+	agent, err := factory(block, globals)
+	fields.CheckUnknown()
+	if err != nil && len(v.d.errs) == errCount {
+		// The factory found a problem of its own rather than through the block.
+		v.errorf("%s", err)
+	}
+	if err != nil || len(v.d.errs) > errCount {
+		return nil, nil
+	}
+	return block, agent
+}
+
+func parseLogging(v value, defaults supervisor.LogConfig) supervisor.LogConfig {
+	config := defaults
+	fields, ok := v.Mapping()
+	if !ok {
+		return config
+	}
+	if v, found := fields.Get("level"); found {
+		if rawLevel, ok := v.String(); ok {
+			level, err := supervisor.ParseLogLevel(rawLevel)
+			if err != nil {
+				v.errorf("Unknown log level '%s'", v.Raw())
+			}
+			config.Level = level
 		}
-		return otelcol.NewOtelCol(agentName, dataDir, logDir, exec.(string), opampUrl, apiKey), nil
-	case "nrdot":
-		exec, found := config["executable"]
-		if !found {
-			return nil, fmt.Errorf("No executable defined")
+	}
+	if v, found := fields.Get("encoding"); found {
+		if rawEncoding, ok := v.String(); ok {
+			encoding, err := supervisor.ParseLogEncoding(rawEncoding)
+			if err != nil {
+				v.errorf("Unknown log encoding '%s'", v.Raw())
+			}
+			config.Encoding = encoding
 		}
-		return otelcol.NewNrDot(agentName, dataDir, logDir, exec.(string)), nil
-	default:
-		return nil, fmt.Errorf("Unknown agent type '%s'", agentType)
 	}
+	fields.CheckUnknown()
+	return config
 }
 
-func findString(config map[string]interface{}, param string) (string, bool) {
-	value, found := config[param]
-	if !found {
-		return "", found
+func parseHTTP(v value, address string) string {
+	fields, ok := v.Mapping()
+	if !ok {
+		return address
+	}
+	if v, found := fields.Get("address"); found {
+		address, _ = v.String()
 	}
-	return value.(string), true
+	fields.CheckUnknown()
+	return address
 }
 
-func (p *MetaParser) Marshal(o map[string]interface{}) ([]byte, error) {
-	return yaml.Marshal(o)
+func parseLogRotation(v value, defaults supervisor.LogRotation) supervisor.LogRotation {
+	rotation := defaults
+	fields, ok := v.Mapping()
+	if !ok {
+		return rotation
+	}
+	if v, found := fields.Get("maxSize"); found {
+		rotation.MaxSize, _ = v.Int()
+	}
+	if v, found := fields.Get("maxBackups"); found {
+		rotation.MaxBackups, _ = v.Int()
+	}
+	if v, found := fields.Get("compress"); found {
+		rotation.Compress, _ = v.Bool()
+	}
+	if v, found := fields.Get("maxAge"); found {
+		rotation.MaxAge, _ = v.Duration()
+	}
+	fields.CheckUnknown()
+	return rotation
+}
+
+func parseRestartPolicy(v value, defaults supervisor.RestartPolicy) supervisor.RestartPolicy {
+	policy := defaults
+	fields, ok := v.Mapping()
+	if !ok {
+		return policy
+	}
+	if v, found := fields.Get("mode"); found {
+		if rawMode, ok := v.String(); ok {
+			mode, err := supervisor.ParseRestartMode(rawMode)
+			if err != nil {
+				v.errorf("Unknown restart mode '%s'", v.Raw())
+			}
+			policy.Mode = mode
+		}
+	}
+	if v, found := fields.Get("initialBackoff"); found {
+		policy.InitialBackoff, _ = v.Duration()
+	}
+	if v, found := fields.Get("maxBackoff"); found {
+		policy.MaxBackoff, _ = v.Duration()
+	}
+	if v, found := fields.Get("window"); found {
+		policy.Window, _ = v.Duration()
+	}
+	if v, found := fields.Get("maxRestarts"); found {
+		policy.MaxRestarts, _ = v.Int()
+	}
+	if v, found := fields.Get("jitter"); found {
+		if jitter, ok := v.Float(); ok {
+			if jitter < 0 || jitter > 1 {
+				v.errorf("must be between 0 and 1")
+			}
+			policy.Jitter = jitter
+		}
+	}
+	fields.CheckUnknown()
+	return policy
 }
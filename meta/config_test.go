@@ -2,7 +2,12 @@ package meta
 
 import (
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zapcore"
+	"superagent/otelcol"
+	"superagent/process"
+	"superagent/supervisor"
 	"testing"
+	"time"
 )
 
 func TestMetaConfig(t *testing.T) {
@@ -27,23 +32,294 @@ func TestMetaConfig(t *testing.T) {
 func TestWrongAgentType(t *testing.T) {
 	configPath := "testdata/meta_config_wrong_agent_type.yaml"
 	_, err := LoadConfig(configPath)
-	assert.EqualErrorf(t, err, "Unknown agent type 'unknown-type'", "Wrong error message")
+	assert.EqualErrorf(t, err, "testdata/meta_config_wrong_agent_type.yaml:9:11: agents[1].type: Unknown agent type 'unknown-type'", "Wrong error message")
 }
 
 func TestNoAgentType(t *testing.T) {
 	configPath := "testdata/meta_config_no_agent_type.yaml"
 	_, err := LoadConfig(configPath)
-	assert.EqualErrorf(t, err, "Undefined type for agent 'unknown-name'", "Wrong error message")
+	assert.EqualErrorf(t, err, "testdata/meta_config_no_agent_type.yaml:9:5: agents[1].type: Undefined type for agent 'unknown-name'", "Wrong error message")
 }
 
 func TestRepeatedAgent(t *testing.T) {
 	configPath := "testdata/meta_config_repeated_agent.yaml"
 	_, err := LoadConfig(configPath)
-	assert.EqualErrorf(t, err, "Agent 'nrdot-name' defined multiple times", "Wrong error message")
+	assert.EqualErrorf(t, err, "testdata/meta_config_repeated_agent.yaml:10:11: agents[1].name: Agent 'nrdot-name' defined multiple times", "Wrong error message")
 }
 
 func TestUnknownParameter(t *testing.T) {
 	configPath := "testdata/meta_config_unknown_param.yaml"
 	_, err := LoadConfig(configPath)
-	assert.EqualErrorf(t, err, "Unknown parameter 'unknownParam'", "Wrong error message")
+	assert.EqualErrorf(t, err, "testdata/meta_config_unknown_param.yaml:5:1: unknownParam: Unknown parameter 'unknownParam'", "Wrong error message")
+}
+
+func TestLogRotation(t *testing.T) {
+	configPath := "testdata/meta_config_log_rotation.yaml"
+	meta, err := LoadConfig(configPath)
+	assert.Nil(t, err)
+
+	expected := supervisor.LogRotation{MaxSize: 10, MaxAge: time.Hour, MaxBackups: 3, Compress: false}
+	assert.Equal(t, meta.LogRotation, expected)
+	agent := meta.Agents[0].(*otelcol.OtelCol)
+	assert.Equal(t, agent.LogRotation, expected)
+	assert.Equal(t, agent.LogDir, "/var/log/newrelic/meta/otelcol/otelcol-name")
+}
+
+func TestDefaultLogRotation(t *testing.T) {
+	configPath := "testdata/meta_config.yaml"
+	meta, err := LoadConfig(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, meta.LogRotation, supervisor.DefaultLogRotation())
+}
+
+func TestRestartPolicy(t *testing.T) {
+	configPath := "testdata/meta_config_restart_policy.yaml"
+	meta, err := LoadConfig(configPath)
+	assert.Nil(t, err)
+
+	expected := supervisor.RestartPolicy{
+		Mode:           supervisor.RestartOnFailure,
+		InitialBackoff: 2 * time.Second,
+		MaxBackoff:     time.Minute,
+		Jitter:         0.5,
+		MaxRestarts:    3,
+		Window:         5 * time.Minute,
+	}
+	assert.Equal(t, meta.Agents[0].(*otelcol.OtelCol).RestartPolicy, expected)
+	assert.Equal(t, meta.Agents[1].(*otelcol.OtelCol).RestartPolicy, supervisor.DefaultRestartPolicy())
+}
+
+func TestWrongRestartMode(t *testing.T) {
+	configPath := "testdata/meta_config_wrong_restart_mode.yaml"
+	_, err := LoadConfig(configPath)
+	assert.EqualErrorf(t, err, "testdata/meta_config_wrong_restart_mode.yaml:10:13: agents[0].restartPolicy.mode: Unknown restart mode 'sometimes'", "Wrong error message")
+}
+
+func TestProcessAgent(t *testing.T) {
+	configPath := "testdata/meta_config_process.yaml"
+	meta, err := LoadConfig(configPath)
+	assert.Nil(t, err)
+
+	helper := meta.Agents[0].(*process.Process)
+	assert.Equal(t, helper.GetType(), "process")
+	assert.Equal(t, helper.Executable, "/usr/bin/helper")
+	assert.Equal(t, helper.Args, []string{"--verbose", "--port", "8080"})
+	assert.Equal(t, helper.Env, []string{"HELPER_HOME=/opt/helper", "HELPER_MODE=fast"})
+	assert.Equal(t, helper.WorkingDir, "/opt/helper")
+	assert.Equal(t, helper.RestartPolicy.Mode, supervisor.RestartNever)
+	assert.Equal(t, helper.DataDir, "/etc/newrelic/meta/process/helper")
+}
+
+func TestValidate(t *testing.T) {
+	configPath := "testdata/meta_config_invalid.yaml"
+	problems := Validate(configPath)
+
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, problem.Error())
+	}
+	assert.Equal(t, []string{
+		"testdata/meta_config_invalid.yaml:1:1: opampUrl: No opampUrl defined",
+		"testdata/meta_config_invalid.yaml:4:1: unknownParam: Unknown parameter 'unknownParam'",
+		"testdata/meta_config_invalid.yaml:8:17: agents[0].executable: Cannot run executable 'testdata/no-such-otelcol': no such file or directory",
+		"testdata/meta_config_invalid.yaml:10:11: agents[1].name: Agent 'otelcol-name' defined multiple times",
+		"testdata/meta_config_invalid.yaml:14:17: agents[2].executable: Cannot run executable 'testdata/meta_config.yaml': permission denied",
+	}, messages)
+}
+
+func TestValidateValidConfig(t *testing.T) {
+	assert.Empty(t, Validate("testdata/meta_config_valid.yaml"))
+}
+
+func TestMalformedConfig(t *testing.T) {
+	configPath := "testdata/meta_config_malformed.yaml"
+	_, err := LoadConfig(configPath)
+
+	var messages []string
+	for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+		configErr, ok := e.(*ConfigError)
+		assert.True(t, ok)
+		assert.Equal(t, configPath, configErr.File)
+		messages = append(messages, configErr.Error())
+	}
+	assert.Equal(t, []string{
+		"testdata/meta_config_malformed.yaml:1:1: apiKey: No apiKey defined",
+		"testdata/meta_config_malformed.yaml:3:10: dataDir: must be a string",
+		"testdata/meta_config_malformed.yaml:5:12: logRotation.maxSize: must be an integer",
+		"testdata/meta_config_malformed.yaml:6:11: logRotation.maxAge: must be a duration such as '5s'",
+		"testdata/meta_config_malformed.yaml:9:11: agents[0].name: must be a string",
+		"testdata/meta_config_malformed.yaml:12:17: agents[1].executable: must be a string",
+		"testdata/meta_config_malformed.yaml:14:5: agents[1].jitter: Unknown parameter 'jitter'",
+		"testdata/meta_config_malformed.yaml:15:5: agents[2].executable: No executable defined",
+		"testdata/meta_config_malformed.yaml:20:15: agents[2].restartPolicy.jitter: must be between 0 and 1",
+		"testdata/meta_config_malformed.yaml:21:20: agents[2].restartPolicy.maxRestarts: must be an integer",
+		"testdata/meta_config_malformed.yaml:22:5: agents[3]: must be a map",
+	}, messages)
+}
+
+func TestAgentsNotAList(t *testing.T) {
+	_, err := Parser().Unmarshal([]byte("apiKey: key\nopampUrl: url\ndataDir: /data\nlogDir: /log\nagents: {}\n"))
+	assert.EqualError(t, err, "5:9: agents: must be a list")
+}
+
+func TestReferences(t *testing.T) {
+	t.Setenv("OPAMP_HOST", "opamp.example.com")
+	t.Setenv("HELPER_BIN", "/usr/bin/helper")
+	configPath := "testdata/meta_config_references.yaml"
+	meta, err := LoadConfig(configPath)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "s3cr3t-key", meta.ApiKey)
+	assert.Equal(t, "https://opamp.example.com/v1/opamp", meta.OpampUrl)
+	assert.Equal(t, "/etc/newrelic/meta", meta.DataDir)
+
+	helper := meta.Agents[0].(*process.Process)
+	assert.Equal(t, "/usr/bin/helper", helper.Executable)
+	assert.Equal(t, []string{"--price", "${NOT_A_REFERENCE}"}, helper.Args)
+	assert.Equal(t, []string{"HELPER_TOKEN=s3cr3t-key"}, helper.Env)
+	assert.Equal(t, 2*time.Second, helper.RestartPolicy.InitialBackoff)
+}
+
+func TestUnresolvedReferences(t *testing.T) {
+	t.Setenv("AGENT_TYPE", "s3cr3t-type")
+	configPath := "testdata/meta_config_unresolved_references.yaml"
+	_, err := LoadConfig(configPath)
+	assert.EqualErrorf(t, err,
+		"testdata/meta_config_unresolved_references.yaml:1:9: apiKey: Cannot resolve ${file:testdata/secrets/no_such_key}: cannot read file: no such file or directory\n"+
+			"testdata/meta_config_unresolved_references.yaml:2:11: opampUrl: Cannot resolve ${UNSET_OPAMP_HOST}: environment variable UNSET_OPAMP_HOST is not set\n"+
+			"testdata/meta_config_unresolved_references.yaml:6:11: agents[0].type: Unknown agent type '${AGENT_TYPE}'",
+		"Wrong error message")
+}
+
+func TestReferencesNotInErrors(t *testing.T) {
+	t.Setenv("OPAMP_HOST", "opamp.example.com")
+	t.Setenv("HELPER_BIN", "/no/such/s3cr3t-key")
+	problems := Validate("testdata/meta_config_references.yaml")
+	assert.NotEmpty(t, problems)
+	for _, problem := range problems {
+		assert.NotContains(t, problem.Error(), "s3cr3t-key")
+	}
+}
+
+func TestDropInDir(t *testing.T) {
+	assert.Equal(t, "/etc/newrelic/meta.d", DropInDir("/etc/newrelic/meta.yaml"))
+}
+
+func TestDropInFragments(t *testing.T) {
+	configPath := "testdata/meta_config_dropin.yaml"
+	meta, err := LoadConfig(configPath)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "/etc/newrelic/meta", meta.DataDir)
+	assert.Equal(t, "/var/log/team-a", meta.LogDir)
+	assert.Equal(t, 50, meta.LogRotation.MaxSize)
+	assert.Equal(t, 2, meta.LogRotation.MaxBackups)
+
+	var names []string
+	for _, agent := range meta.Agents {
+		names = append(names, agent.GetName())
+	}
+	assert.Equal(t, []string{"otelcol-name", "team-a-helper", "team-b-nrdot"}, names)
+
+	helper := meta.Agents[1].(*process.Process)
+	assert.Equal(t, "/var/log/team-a/process/team-a-helper", helper.LogDir)
+}
+
+func TestValidateDropInFragments(t *testing.T) {
+	problems := Validate("testdata/meta_config_dropin.yaml")
+
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, problem.Error())
+	}
+	// By file, in the order they are loaded, then by position, whatever the lines.
+	assert.Equal(t, []string{
+		"testdata/meta_config_dropin.yaml:10:17: agents[0].executable: Cannot run executable '/usr/bin/otelcol': no such file or directory",
+		"testdata/meta_config_dropin.d/10-team-a.yaml:5:17: agents[0].executable: Cannot run executable '/usr/bin/helper': no such file or directory",
+		"testdata/meta_config_dropin.d/20-team-b.yaml:6:17: agents[0].executable: Cannot run executable '/usr/bin/nrdot': no such file or directory",
+	}, messages)
+}
+
+func TestDropInRepeatedAgent(t *testing.T) {
+	configPath := "testdata/meta_config_dropin_repeated.yaml"
+	_, err := LoadConfig(configPath)
+	assert.EqualErrorf(t, err,
+		"testdata/meta_config_dropin_repeated.d/10-team-a.yaml:3:11: agents[0].name: Agent 'otelcol-name' defined multiple times, first in testdata/meta_config_dropin_repeated.yaml:7:11\n"+
+			"testdata/meta_config_dropin_repeated.d/10-team-a.yaml:8:5: agents[1].unknownParam: Unknown parameter 'unknownParam'",
+		"Wrong error message")
+}
+
+func TestAgentOverrides(t *testing.T) {
+	configPath := "testdata/meta_config_agent_overrides.yaml"
+	meta, err := LoadConfig(configPath)
+	assert.Nil(t, err)
+
+	nrdot := meta.Agents[0].(*otelcol.Nrdot)
+	assert.Equal(t, "https://team-a.example.com/v1/opamp", nrdot.OpampUrl)
+	assert.Equal(t, "team-a-key", nrdot.ApiKey)
+	assert.Equal(t, map[string]string{"X-Team": "team-a"}, nrdot.Headers)
+	assert.Equal(t, []string{"--feature-gates", "+exporter.foo"}, nrdot.Args)
+	assert.Equal(t, []string{"GOMAXPROCS=2"}, nrdot.Env)
+	assert.Equal(t, "/opt/team-a", nrdot.WorkingDir)
+
+	// The agents without overrides use the global settings.
+	collector := meta.Agents[1].(*otelcol.OtelCol)
+	assert.Equal(t, "url", collector.OpampUrl)
+	assert.Equal(t, "key", collector.ApiKey)
+	assert.Nil(t, collector.Headers)
+	assert.Empty(t, collector.WorkingDir)
+}
+
+func TestStartupPolicy(t *testing.T) {
+	meta, err := LoadConfig("testdata/meta_config.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, StartupAllOrNothing, meta.StartupPolicy)
+
+	_, err = Parser().Unmarshal([]byte("apiKey: key\nopampUrl: url\ndataDir: /data\nlogDir: /log\nstartupPolicy: sometimes\n"))
+	assert.EqualErrorf(t, err, "5:16: startupPolicy: Unknown startup policy 'sometimes'", "Wrong error message")
+}
+
+func TestDependencies(t *testing.T) {
+	meta, err := LoadConfig("testdata/meta_config_dependencies.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{"edge": {"gateway"}}, meta.DependsOn)
+}
+
+func TestDependencyCycle(t *testing.T) {
+	configPath := "testdata/meta_config_dependency_cycle.yaml"
+	_, err := LoadConfig(configPath)
+	assert.EqualErrorf(t, err,
+		"testdata/meta_config_dependency_cycle.yaml:13:20: agents[1].dependsOn[1]: Unknown agent 'unknown'\n"+
+			"testdata/meta_config_dependency_cycle.yaml:17:17: agents[2].dependsOn[0]: Dependency cycle: a -> b -> c -> a\n"+
+			"testdata/meta_config_dependency_cycle.yaml:21:17: agents[3].dependsOn[0]: Dependency cycle: d -> d",
+		"Wrong error message")
+}
+
+func TestHTTPAndRequired(t *testing.T) {
+	meta, err := LoadConfig("testdata/meta_config_http.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:8686", meta.HTTPAddress)
+	assert.Equal(t, map[string]bool{"gateway": true, "helper": false}, meta.Required)
+}
+
+func TestLogging(t *testing.T) {
+	meta, err := LoadConfig("testdata/meta_config.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, supervisor.DefaultLogConfig(), meta.Logging)
+
+	meta, err = LoadConfig("testdata/meta_config_logging.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, supervisor.LogConfig{Level: zapcore.DebugLevel, Encoding: supervisor.LogEncodingJSON}, meta.Logging)
+
+	_, err = Parser().Unmarshal([]byte("apiKey: key\nopampUrl: url\ndataDir: /data\nlogDir: /log\nlogging:\n  level: chatty\n  encoding: xml\n"))
+	assert.EqualErrorf(t, err, "6:10: logging.level: Unknown log level 'chatty'\n7:13: logging.encoding: Unknown log encoding 'xml'", "Wrong error message")
+}
+
+func TestPinnedInstanceId(t *testing.T) {
+	meta, err := Parser().Unmarshal([]byte("apiKey: key\nopampUrl: url\ndataDir: /data\nlogDir: /log\nagents:\n  - type: nrdot\n    name: gateway\n    executable: /usr/bin/nrdot\n    instanceId: 01GTEVKE9Q06AFVGQT5ZYC0GEK\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "01GTEVKE9Q06AFVGQT5ZYC0GEK", meta["agents"].([]Agent)[0].(*otelcol.Nrdot).InstanceId.String())
+
+	_, err = Parser().Unmarshal([]byte("apiKey: key\nopampUrl: url\ndataDir: /data\nlogDir: /log\nagents:\n  - type: otelcol\n    name: gateway\n    executable: /usr/bin/otelcol\n    instanceId: gateway-1\n"))
+	assert.EqualErrorf(t, err, "9:17: agents[0].instanceId: Invalid instance id 'gateway-1'", "Wrong error message")
 }
@@ -0,0 +1,187 @@
+package meta
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"superagent/control"
+	"superagent/supervisor"
+)
+
+// ControlSocketPath returns the path of the control socket of the meta agent whose data directory is dataDir.
+func ControlSocketPath(dataDir string) string {
+	return filepath.Join(dataDir, "superagent.sock")
+}
+
+// Status returns the overall state of the meta agent, for the control socket.
+func (m *MetaAgent) Status() control.Status {
+	agents := m.Agents()
+	status := control.Status{Healthy: true, Agents: len(agents)}
+	for _, agent := range agents {
+		if agent.State == string(supervisor.StateRunning) {
+			status.RunningAgents++
+		}
+		if !agent.Healthy {
+			status.Healthy = false
+		}
+	}
+	return status
+}
+
+// Agents returns the state of every agent of the config, in the order of the config.
+func (m *MetaAgent) Agents() []control.AgentStatus {
+	health := m.Health()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.options.Clock.Now()
+	agents := make([]control.AgentStatus, 0, len(m.config.Agents))
+	for _, agent := range m.config.Agents {
+		status := control.AgentStatus{
+			Name:     agent.GetName(),
+			Type:     agent.GetType(),
+			Required: m.config.Required[agent.GetName()],
+			State:    string(supervisor.StateStopped),
+		}
+		if h, found := health[agent.GetName()]; found {
+			status.Healthy, status.State, status.LastError, status.StartTime = h.Healthy, string(h.State), h.LastError, h.StartTime
+		}
+		if sup, running := m.supervisors[agent.GetName()]; running {
+			s := sup.Status()
+			status.Pid, status.Restarts, status.LastExitCode = s.Pid, s.Restarts, s.LastExitCode
+			status.OpampConnection, status.ConfigHash = string(s.OpampConnection), s.ConfigHash
+		}
+		if !status.StartTime.IsZero() {
+			status.UptimeSeconds = int64(now.Sub(status.StartTime).Seconds())
+		}
+		agents = append(agents, status)
+	}
+	return agents
+}
+
+// Ready tells whether every required agent is running and healthy.
+func (m *MetaAgent) Ready() bool {
+	return control.Ready(m.Agents())
+}
+
+// StartAgent starts an agent of the config that is not running.
+func (m *MetaAgent) StartAgent(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	agent, err := m.findAgent(name)
+	if err != nil {
+		return err
+	}
+	if !m.started() {
+		return fmt.Errorf("cannot start agent '%s': %w", name, ErrNotStarted)
+	}
+	if _, found := m.supervisors[name]; found {
+		return fmt.Errorf("cannot start agent '%s': %w", name, control.ErrAgentRunning)
+	}
+	return m.startOne(agent)
+}
+
+// StopAgent stops a running agent. It is started again by the next reload.
+func (m *MetaAgent) StopAgent(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.findAgent(name); err != nil {
+		return err
+	}
+	if _, found := m.supervisors[name]; !found {
+		return fmt.Errorf("cannot stop agent '%s': %w", name, control.ErrAgentNotRunning)
+	}
+	return m.stopOne(ctx, name)
+}
+
+// RestartAgent restarts the process of a running agent, or starts an agent that is not running.
+func (m *MetaAgent) RestartAgent(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	agent, err := m.findAgent(name)
+	if err != nil {
+		return err
+	}
+	if !m.started() {
+		return fmt.Errorf("cannot restart agent '%s': %w", name, ErrNotStarted)
+	}
+	if sup, found := m.supervisors[name]; found {
+		ctx, cancel := context.WithTimeout(ctx, m.config.ShutdownTimeout)
+		defer cancel()
+		// Restarting may take up to the shutdown timeout, the agents can be checked and controlled meanwhile.
+		m.mu.Unlock()
+		err := sup.Restart(ctx)
+		m.mu.Lock()
+		if err != nil {
+			return fmt.Errorf("cannot restart agent '%s': %w", name, err)
+		}
+		return nil
+	}
+	return m.startOne(agent)
+}
+
+// EffectiveConfig returns the config a running agent got from its OpAMP server.
+func (m *MetaAgent) EffectiveConfig(name string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.findAgent(name); err != nil {
+		return "", err
+	}
+	sup, found := m.supervisors[name]
+	if !found {
+		return "", fmt.Errorf("agent '%s': %w", name, control.ErrAgentNotRunning)
+	}
+	reporter, ok := sup.(supervisor.EffectiveConfigReporter)
+	if !ok {
+		return "", fmt.Errorf("effective config of agent '%s': %w", name, control.ErrUnsupported)
+	}
+	return reporter.GetEffectiveConfig(), nil
+}
+
+func (m *MetaAgent) findAgent(name string) (Agent, error) {
+	for _, agent := range m.config.Agents {
+		if agent.GetName() == name {
+			return agent, nil
+		}
+	}
+	return nil, fmt.Errorf("agent '%s': %w", name, control.ErrUnknownAgent)
+}
+
+// startOne starts agent once the agents it depends on are running. m.mu must be held, it is released while
+// waiting for them so the agents can be checked and controlled meanwhile.
+func (m *MetaAgent) startOne(agent Agent) error {
+	if m.starting[agent.GetName()] {
+		return fmt.Errorf("cannot start agent '%s': %w", agent.GetName(), control.ErrAgentRunning)
+	}
+	sups := make([]supervisor.Supervisor, 1)
+	err := m.startAgents([]Agent{agent}, sups, func(i int) error {
+		var err error
+		sups[i], err = m.startAgent(agent, nil, nil)
+		return err
+	})[0]
+	if err != nil {
+		return err
+	}
+	delete(m.failed, agent.GetName())
+	return nil
+}
+
+// stopOne stops the running agent name. m.mu must be held, it is released while the agent stops so the agents
+// can be checked and controlled meanwhile. The agent is kept as running until it is stopped, so it is not
+// started again in the meantime.
+func (m *MetaAgent) stopOne(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.config.ShutdownTimeout)
+	defer cancel()
+	sup := m.supervisors[name]
+	m.mu.Unlock()
+	err := sup.Stop(ctx)
+	m.mu.Lock()
+	// A reload may have replaced the agent meanwhile.
+	if m.supervisors[name] == sup {
+		delete(m.supervisors, name)
+		delete(m.agents, name)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot stop agent '%s': %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package meta
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConfigError is a problem found in a config file, along with where it was found.
+type ConfigError struct {
+	File   string
+	Line   int
+	Column int
+	// Key path of the faulty value, such as agents[1].executable.
+	Path    string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File + ":")
+	}
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "%d:%d:", e.Line, e.Column)
+	}
+	if b.Len() > 0 {
+		b.WriteString(" ")
+	}
+	if e.Path != "" {
+		b.WriteString(e.Path + ": ")
+	}
+	b.WriteString(e.Message)
+	return b.String()
+}
+
+// decoder walks the yaml nodes of a config file and collects every problem found on the way.
+// It never panics on malformed input: a value of the wrong kind is reported and skipped.
+type decoder struct {
+	file string
+	errs []error
+}
+
+func (d *decoder) newError(node *yaml.Node, path string, format string, args ...interface{}) *ConfigError {
+	err := &ConfigError{File: d.file, Path: path, Message: fmt.Sprintf(format, args...)}
+	if node != nil {
+		err.Line, err.Column = node.Line, node.Column
+	}
+	return err
+}
+
+func (d *decoder) errorf(node *yaml.Node, path string, format string, args ...interface{}) {
+	d.errs = append(d.errs, d.newError(node, path, format, args...))
+}
+
+// sortErrors orders the problems by file, in the order of files, then by their position in the file.
+func sortErrors(errs []error, files []string) {
+	rank := make(map[string]int)
+	for i, file := range files {
+		rank[file] = i
+	}
+	sort.SliceStable(errs, func(i, j int) bool {
+		a, aOk := errs[i].(*ConfigError)
+		b, bOk := errs[j].(*ConfigError)
+		if !aOk || !bOk {
+			return false
+		}
+		if a.File != b.File {
+			return rank[a.File] < rank[b.File]
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// value is a node of the config file along with its key path.
+type value struct {
+	d    *decoder
+	node *yaml.Node
+	path string
+}
+
+func newValue(d *decoder, node *yaml.Node, path string) value {
+	// Follow aliases, so anchors can be used to share parts of the config.
+	for node != nil && node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return value{d: d, node: node, path: path}
+}
+
+func (v value) errorf(format string, args ...interface{}) {
+	v.d.errorf(v.node, v.path, format, args...)
+}
+
+func (v value) scalar(tag string, what string) (*yaml.Node, bool) {
+	if v.node == nil || v.node.Kind != yaml.ScalarNode || v.node.ShortTag() != tag {
+		v.errorf("must be %s", what)
+		return nil, false
+	}
+	return v.node, true
+}
+
+// text returns a scalar with its ${...} references resolved.
+func (v value) text(tag string, what string) (string, bool) {
+	node, ok := v.scalar(tag, what)
+	if !ok {
+		return "", false
+	}
+	s, errs := expand(node.Value)
+	for _, err := range errs {
+		v.errorf("%s", err)
+	}
+	return s, len(errs) == 0
+}
+
+// Raw returns a scalar as written in the file, before its references are resolved.
+// Error messages must quote it rather than the resolved value, which may be a secret.
+func (v value) Raw() string {
+	if v.node == nil {
+		return ""
+	}
+	return v.node.Value
+}
+
+func (v value) String() (string, bool) {
+	return v.text("!!str", "a string")
+}
+
+func (v value) Int() (int, bool) {
+	var i int
+	node, ok := v.scalar("!!int", "an integer")
+	if !ok {
+		return 0, false
+	}
+	if err := node.Decode(&i); err != nil {
+		v.errorf("must be an integer")
+		return 0, false
+	}
+	return i, true
+}
+
+func (v value) Bool() (bool, bool) {
+	var b bool
+	node, ok := v.scalar("!!bool", "true or false")
+	if !ok {
+		return false, false
+	}
+	if err := node.Decode(&b); err != nil {
+		v.errorf("must be true or false")
+		return false, false
+	}
+	return b, true
+}
+
+func (v value) Float() (float64, bool) {
+	var f float64
+	if v.node == nil || v.node.Kind != yaml.ScalarNode || (v.node.ShortTag() != "!!float" && v.node.ShortTag() != "!!int") {
+		v.errorf("must be a number")
+		return 0, false
+	}
+	if err := v.node.Decode(&f); err != nil {
+		v.errorf("must be a number")
+		return 0, false
+	}
+	return f, true
+}
+
+func (v value) Duration() (time.Duration, bool) {
+	s, ok := v.text("!!str", "a duration such as '5s'")
+	if !ok {
+		return 0, false
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		v.errorf("must be a duration such as '5s'")
+		return 0, false
+	}
+	return d, true
+}
+
+func (v value) Sequence() ([]value, bool) {
+	if v.node == nil || v.node.Kind != yaml.SequenceNode {
+		v.errorf("must be a list")
+		return nil, false
+	}
+	items := make([]value, 0, len(v.node.Content))
+	for i, item := range v.node.Content {
+		items = append(items, newValue(v.d, item, fmt.Sprintf("%s[%d]", v.path, i)))
+	}
+	return items, true
+}
+
+func (v value) Mapping() (*mapping, bool) {
+	if v.node == nil || v.node.Kind != yaml.MappingNode {
+		v.errorf("must be a map")
+		return nil, false
+	}
+	m := &mapping{value: v, values: make(map[string]value), keyNodes: make(map[string]*yaml.Node), used: make(map[string]bool)}
+	for i := 0; i+1 < len(v.node.Content); i += 2 {
+		keyNode := v.node.Content[i]
+		if keyNode.Kind != yaml.ScalarNode {
+			v.d.errorf(keyNode, v.path, "keys must be strings")
+			continue
+		}
+		key := keyNode.Value
+		if _, found := m.values[key]; found {
+			v.d.errorf(keyNode, m.childPath(key), "Parameter '%s' defined multiple times", key)
+			continue
+		}
+		m.keys = append(m.keys, key)
+		m.keyNodes[key] = keyNode
+		m.values[key] = newValue(v.d, v.node.Content[i+1], m.childPath(key))
+	}
+	return m, true
+}
+
+// mapping is a map of the config file. It remembers which keys were read, so the others can be
+// reported as unknown.
+type mapping struct {
+	value
+	keys     []string
+	values   map[string]value
+	keyNodes map[string]*yaml.Node
+	used     map[string]bool
+}
+
+func (m *mapping) childPath(key string) string {
+	if m.path == "" {
+		return key
+	}
+	return m.path + "." + key
+}
+
+func (m *mapping) Get(key string) (value, bool) {
+	v, found := m.values[key]
+	m.used[key] = true
+	return v, found
+}
+
+// Require returns the value of key, and reports it if it is not defined.
+func (m *mapping) Require(key string, format string, args ...interface{}) (value, bool) {
+	v, found := m.Get(key)
+	if !found {
+		m.d.errorf(m.node, m.childPath(key), format, args...)
+	}
+	return v, found
+}
+
+// CheckUnknown reports every key that was not read.
+func (m *mapping) CheckUnknown() {
+	for _, key := range m.keys {
+		if !m.used[key] {
+			m.d.errorf(m.keyNodes[key], m.childPath(key), "Unknown parameter '%s'", key)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package meta
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// dependency is an entry of the dependsOn list of an agent.
+type dependency struct {
+	name string
+	v    value
+}
+
+// checkDependencies reports the dependencies on unknown agents and the dependency cycles, and returns
+// the dependencies of every agent.
+func checkDependencies(agents []Agent, blocks map[string]*AgentBlock) map[string][]string {
+	dependencies := make(map[string][]dependency)
+	for _, agent := range agents {
+		for _, v := range blocks[agent.GetName()].dependsOn {
+			name, ok := v.String()
+			if !ok {
+				continue
+			}
+			if _, found := blocks[name]; !found {
+				v.errorf("Unknown agent '%s'", v.Raw())
+				continue
+			}
+			dependencies[agent.GetName()] = append(dependencies[agent.GetName()], dependency{name: name, v: v})
+		}
+	}
+
+	var names []string
+	for _, agent := range agents {
+		names = append(names, agent.GetName())
+	}
+	findCycles(names, func(name string) []string {
+		var names []string
+		for _, dependency := range dependencies[name] {
+			names = append(names, dependency.name)
+		}
+		return names
+	}, func(name string, i int, cycle []string) {
+		dependencies[name][i].v.errorf("Dependency cycle: %s -> %s", strings.Join(cycle, " -> "), dependencies[name][i].name)
+	})
+
+	dependsOn := make(map[string][]string)
+	for _, agent := range agents {
+		for _, dependency := range dependencies[agent.GetName()] {
+			dependsOn[agent.GetName()] = append(dependsOn[agent.GetName()], dependency.name)
+		}
+	}
+	return dependsOn
+}
+
+// checkDependsOn returns the problems of dependsOn, which is not checked when it is not loaded from a config file:
+// dependencies on unknown agents and dependency cycles.
+func checkDependsOn(agents []Agent, dependsOn map[string][]string) error {
+	known := make(map[string]bool)
+	var names []string
+	for _, agent := range agents {
+		known[agent.GetName()] = true
+		names = append(names, agent.GetName())
+	}
+	var errs []error
+	for _, name := range names {
+		for _, dependency := range dependsOn[name] {
+			if !known[dependency] {
+				errs = append(errs, fmt.Errorf("agent '%s' depends on unknown agent '%s'", name, dependency))
+			}
+		}
+	}
+	findCycles(names, func(name string) []string {
+		return dependsOn[name]
+	}, func(name string, i int, cycle []string) {
+		errs = append(errs, fmt.Errorf("dependency cycle: %s -> %s", strings.Join(cycle, " -> "), dependsOn[name][i]))
+	})
+	return errors.Join(errs...)
+}
+
+// findCycles walks the dependencies of the named agents depth-first, in order, and calls cycle for every
+// dependency that closes a cycle: the i-th dependency of the agent name, with the agents of the cycle.
+func findCycles(names []string, dependencies func(name string) []string, cycle func(name string, i int, cycle []string)) {
+	// An agent found again while its dependencies are being visited closes a cycle.
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	var path []string
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = visiting
+		path = append(path, name)
+		for i, dependency := range dependencies(name) {
+			switch state[dependency] {
+			case visiting:
+				agents := path
+				for agents[0] != dependency {
+					agents = agents[1:]
+				}
+				cycle(name, i, agents)
+			case 0:
+				visit(dependency)
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+	}
+	for _, name := range names {
+		if state[name] == 0 {
+			visit(name)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package meta
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// expand resolves the ${ENV_VAR}, ${ENV_VAR:-default} and ${file:/path} references in s.
+// $${ is kept as a literal ${. The errors only mention the references, never what they resolve to,
+// since references are typically used for secrets.
+func expand(s string) (string, []error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var b strings.Builder
+	var errs []error
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			b.WriteString(s)
+			break
+		}
+		if start > 0 && s[start-1] == '$' {
+			// Escaped reference.
+			b.WriteString(s[:start-1] + "${")
+			s = s[start+2:]
+			continue
+		}
+		b.WriteString(s[:start])
+		end := strings.Index(s[start:], "}")
+		if end < 0 {
+			errs = append(errs, fmt.Errorf("Unterminated reference '%s'", s[start:]))
+			break
+		}
+		reference := s[start : start+end+1]
+		resolved, err := resolve(reference[2 : len(reference)-1])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Cannot resolve %s: %w", reference, err))
+		}
+		b.WriteString(resolved)
+		s = s[start+end+1:]
+	}
+	return b.String(), errs
+}
+
+func resolve(reference string) (string, error) {
+	if path, found := strings.CutPrefix(reference, "file:"); found {
+		if path == "" {
+			return "", errors.New("no file name")
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			var pathErr *os.PathError
+			if errors.As(err, &pathErr) {
+				return "", fmt.Errorf("cannot read file: %w", pathErr.Err)
+			}
+			return "", errors.New("cannot read file")
+		}
+		// Secret files usually end with a new line that is not part of the secret.
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+
+	name, defaultValue, hasDefault := strings.Cut(reference, ":-")
+	if name == "" {
+		return "", errors.New("no variable name")
+	}
+	if value, found := os.LookupEnv(name); found && (value != "" || !hasDefault) {
+		return value, nil
+	}
+	if hasDefault {
+		return defaultValue, nil
+	}
+	return "", fmt.Errorf("environment variable %s is not set", name)
+}
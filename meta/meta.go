@@ -1,48 +1,629 @@
 package meta
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"reflect"
+	"sort"
+	"superagent/control"
+	"superagent/events"
+	"superagent/metrics"
+	"superagent/opamp"
 	"superagent/supervisor"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// StartupPolicy tells what to do when some agents cannot be started.
+type StartupPolicy string
+
+const (
+	// StartupAllOrNothing stops the agents already started when one fails, so either all run or none does.
+	StartupAllOrNothing StartupPolicy = "all-or-nothing"
+	// StartupBestEffort keeps the agents that started running, and reports the others as degraded.
+	StartupBestEffort StartupPolicy = "best-effort"
+)
+
+const (
+	DefaultMaxConcurrency  = 8
+	DefaultShutdownTimeout = 30 * time.Second
+)
+
+// How long an agent waits for the agents it depends on to be running, and how often it checks.
+var dependencyTimeout = 30 * time.Second
+
+const dependencyCheckInterval = 100 * time.Millisecond
+
+// How often Run checks the health of the agents.
+const healthCheckInterval = 5 * time.Second
+
+// ErrDegraded is returned by Start, along with the failures, when some agents could not be started
+// and the others are kept running.
+var ErrDegraded = errors.New("some agents could not be started")
+
+// ErrNotStarted is returned when the agents are controlled before Start, or after Stop.
+var ErrNotStarted = errors.New("the meta agent is not started")
+
+func ParseStartupPolicy(policy string) (StartupPolicy, error) {
+	switch StartupPolicy(policy) {
+	case StartupAllOrNothing, StartupBestEffort:
+		return StartupPolicy(policy), nil
+	}
+	return "", fmt.Errorf("Unknown startup policy '%s'", policy)
+}
+
 type MetaAgent struct {
+	configPath string
+	// Serializes Start, Stop and Reload, which release mu while the agents wait for their dependencies.
+	lifecycle   sync.Mutex
+	mu          sync.Mutex
 	config      Meta
 	supervisors map[string]supervisor.Supervisor
+	// Definitions the running supervisors were created from, to find what changed on reload.
+	agents map[string]Agent
+	// Agents that could not be started, with the reason.
+	failed map[string]error
+	// Agents being started, which are not running yet.
+	starting map[string]bool
+	options  supervisor.Options
+	// What is wrong with the config given to New, returned by Start.
+	configErr error
+	// Lock of DataDir, held while the agents run.
+	lock *supervisor.DirLock
+
+	metricsMu sync.Mutex
+	// Metrics of every agent ever started, by name. They are kept when an agent is restarted or reloaded.
+	metrics map[string]*metrics.Agent
 }
 
-func NewMetaAgent(configPath string) (*MetaAgent, error) {
+// Option customizes a MetaAgent created with New.
+type Option func(m *MetaAgent)
+
+// WithLogger sets the logger of the meta agent and of the supervisors, instead of the one configured
+// by the logging settings.
+func WithLogger(logger *zap.Logger) Option {
+	return func(m *MetaAgent) {
+		m.options.Logger = supervisor.NewLogger(logger)
+	}
+}
+
+// WithClock sets the clock of the meta agent and of the supervisors.
+func WithClock(clock supervisor.Clock) Option {
+	return func(m *MetaAgent) {
+		m.options.Clock = clock
+	}
+}
+
+// WithOpampClientFactory sets how the supervisors create their OpAMP client.
+func WithOpampClientFactory(factory opamp.ClientFactory) Option {
+	return func(m *MetaAgent) {
+		m.options.NewOpampClient = factory
+	}
+}
+
+// New creates a meta agent that runs the agents of config, to embed it in another program.
+// Such a meta agent has no config file, so it cannot be reloaded.
+func New(config *Meta, opts ...Option) *MetaAgent {
+	m := &MetaAgent{config: withDefaults(*config), configErr: checkDependsOn(config.Agents, config.DependsOn)}
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.options.Logger == nil {
+		m.options.Logger = supervisor.NewLogger(supervisor.NewZapLogger(m.config.Logging))
+	}
+	if m.options.Clock == nil {
+		m.options.Clock = supervisor.RealClock{}
+	}
+	m.options.Events = events.NewBus()
+	return m
+}
+
+// Subscribe returns a subscription to the lifecycle events of the agents, buffering up to buffer events.
+// It must be closed when no longer read.
+func (m *MetaAgent) Subscribe(buffer int) *events.Subscription {
+	return m.options.Events.Subscribe(buffer)
+}
+
+// Logger returns the logger of the meta agent.
+func (m *MetaAgent) Logger() *supervisor.Logger {
+	return m.options.Logger
+}
+
+// NewMetaAgent creates a meta agent that runs the agents of the config file at configPath.
+func NewMetaAgent(configPath string, opts ...Option) (*MetaAgent, error) {
 	config, err := LoadConfig(configPath)
 	if err != nil {
 		return nil, err
 	}
-	return &MetaAgent{config: *config}, nil
+	m := New(config, opts...)
+	m.configPath = configPath
+	return m, nil
+}
+
+// Run starts the agents, then blocks until ctx is done, when it stops them. It also stops them and returns
+// an error if an agent is crash-looping, unless the startup policy is best-effort, in which case the agent
+// is only reported as unhealthy.
+func (m *MetaAgent) Run(ctx context.Context) error {
+	if m.config.HTTPAddress != "" {
+		httpServer := control.NewHTTPServer(m, m.options.Logger)
+		if err := httpServer.Listen(m.config.HTTPAddress); err != nil {
+			return fmt.Errorf("cannot serve the health endpoints: %w", err)
+		}
+		// Serve before the agents are started, so the meta agent is seen alive but not ready meanwhile.
+		httpServer.Serve()
+		defer httpServer.Close()
+	}
+
+	err := m.Start()
+	if errors.Is(err, ErrDegraded) {
+		m.options.Logger.Errorf("Meta agent started in degraded mode: %s", err)
+	} else if err != nil {
+		return err
+	}
+
+	server := m.startControlServer()
+	stop := func() error {
+		if server != nil {
+			server.Close()
+		}
+		// ctx may be done already, it cannot bound the shutdown.
+		return m.Stop(context.Background())
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return stop()
+		case <-m.options.Clock.After(healthCheckInterval):
+			if err := m.checkCrashLooping(); err != nil {
+				return errors.Join(err, stop())
+			}
+		}
+	}
+}
+
+// startControlServer serves the control socket, or returns nil if it cannot. The agents keep running
+// without it.
+func (m *MetaAgent) startControlServer() *control.Server {
+	path := ControlSocketPath(m.config.DataDir)
+	server := control.NewServer(path, m, m.options.Logger)
+	err := supervisor.EnsureDirExists(m.config.DataDir)
+	if err == nil {
+		err = server.Start()
+	}
+	if err != nil {
+		m.options.Logger.Errorf("Cannot serve the control socket %s: %s", path, err)
+		return nil
+	}
+	return server
+}
+
+// checkCrashLooping returns an error if an agent gave up restarting and the startup policy does not
+// tolerate it.
+func (m *MetaAgent) checkCrashLooping() error {
+	health := m.Health()
+	names := make([]string, 0, len(health))
+	for name := range health {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if health[name].State != supervisor.StateCrashLooping {
+			continue
+		}
+		if m.config.StartupPolicy != StartupBestEffort {
+			return fmt.Errorf("agent '%s' is crash-looping: %s", name, health[name].LastError)
+		}
+	}
+	return nil
 }
 
+// Start sets up and starts every agent, up to maxConcurrency at a time. An agent is only started once
+// the agents it depends on are running. If one fails, what happens depends
+// on the startup policy: either the agents already started are stopped and Start returns every error,
+// or they are kept running and Start returns ErrDegraded along with the failures.
 func (m *MetaAgent) Start() error {
+	m.lifecycle.Lock()
+	defer m.lifecycle.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.configErr != nil {
+		return m.configErr
+	}
+	if err := m.lockDataDir(); err != nil {
+		return err
+	}
 	m.supervisors = make(map[string]supervisor.Supervisor)
-	for _, agentConfig := range m.config.Agents {
-		sup := agentConfig.GetSupervisor()
-		err := sup.Setup()
-		if err != nil {
-			return err
+	m.agents = make(map[string]Agent)
+	m.failed = make(map[string]error)
+	m.starting = make(map[string]bool)
+
+	agents := m.config.Agents
+	sups := make([]supervisor.Supervisor, len(agents))
+	var aborted atomic.Bool
+	startErrs := m.startAgents(agents, sups, func(i int) error {
+		if aborted.Load() {
+			// Another agent failed, the ones started are going to be stopped anyway.
+			return nil
 		}
-		m.supervisors[agentConfig.GetName()] = sup
-	}
+		var err error
+		sups[i], err = m.startAgent(agents[i], agents, sups)
+		if err != nil && m.config.StartupPolicy != StartupBestEffort {
+			aborted.Store(true)
+		}
+		return err
+	})
 
-	for _, sup := range m.supervisors {
-		err := sup.Start()
+	var started []string
+	for i, agent := range agents {
+		if sups[i] != nil {
+			started = append(started, agent.GetName())
+		}
+	}
+	var errs []error
+	for i, err := range startErrs {
 		if err != nil {
-			return err
+			errs = append(errs, err)
+			m.failed[agents[i].GetName()] = err
 		}
 	}
+	if len(errs) == 0 {
+		return nil
+	}
+	if m.config.StartupPolicy == StartupBestEffort {
+		return fmt.Errorf("%w: %w", ErrDegraded, errors.Join(errs...))
+	}
+
+	m.failed = make(map[string]error)
+	ctx, cancel := context.WithTimeout(context.Background(), m.config.ShutdownTimeout)
+	defer cancel()
+	errs = append(errs, m.stopAgents(ctx, started)...)
+	return errors.Join(append(errs, m.unlockDataDir())...)
+}
+
+// lockDataDir makes sure that no other meta agent uses the data directory.
+func (m *MetaAgent) lockDataDir() error {
+	if m.lock != nil {
+		return nil
+	}
+	if err := supervisor.EnsureDirExists(m.config.DataDir); err != nil {
+		return fmt.Errorf("cannot lock the data directory: %w", err)
+	}
+	lock, err := supervisor.LockDir(m.config.DataDir)
+	if err != nil {
+		return fmt.Errorf("cannot lock the data directory: %w", err)
+	}
+	m.lock = lock
 	return nil
 }
 
-func (m *MetaAgent) Stop() error {
-	for _, sup := range m.supervisors {
-		err := sup.Stop()
+// started tells whether the meta agent runs its agents, between Start and Stop. It holds the lock of DataDir then.
+func (m *MetaAgent) started() bool {
+	return m.lock != nil
+}
+
+func (m *MetaAgent) unlockDataDir() error {
+	if m.lock == nil {
+		return nil
+	}
+	err := m.lock.Unlock()
+	m.lock = nil
+	return err
+}
+
+// startAgents calls start for every agent, once the agents it depends on are done, up to maxConcurrency at a time.
+// m.mu must be held, it is released meanwhile so the agents can be checked and controlled while they wait
+// for their dependencies. The agents are seen as starting until then.
+func (m *MetaAgent) startAgents(agents []Agent, sups []supervisor.Supervisor, start func(i int) error) []error {
+	index := make(map[string]int)
+	for i, agent := range agents {
+		index[agent.GetName()] = i
+	}
+	after := make([][]int, len(agents))
+	for i, agent := range agents {
+		for _, dependency := range m.config.DependsOn[agent.GetName()] {
+			if j, found := index[dependency]; found {
+				after[i] = append(after[i], j)
+			}
+		}
+		m.starting[agent.GetName()] = true
+	}
+	maxConcurrency := m.config.MaxConcurrency
+	m.mu.Unlock()
+	errs := parallel(maxConcurrency, len(agents), func(i int) []int {
+		return after[i]
+	}, start)
+	m.mu.Lock()
+	for _, agent := range agents {
+		delete(m.starting, agent.GetName())
+	}
+	return errs
+}
+
+// startAgent waits until the agents that agent depends on are running, then sets up and starts its supervisor,
+// which is added to the running ones. The dependencies are looked for among the agents being started, then
+// among the running ones. It is called from startAgents, without m.mu.
+func (m *MetaAgent) startAgent(agent Agent, agents []Agent, sups []supervisor.Supervisor) (supervisor.Supervisor, error) {
+	m.mu.Lock()
+	dependencies := m.dependencies(agent, agents, sups)
+	m.mu.Unlock()
+	if err := m.waitDependencies(agent, dependencies); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// The meta agent may have been stopped meanwhile.
+	if !m.started() {
+		return nil, fmt.Errorf("cannot start agent '%s': %w", agent.GetName(), ErrNotStarted)
+	}
+	sup, err := m.launchAgent(agent)
+	if err != nil {
+		return nil, err
+	}
+	m.supervisors[agent.GetName()] = sup
+	m.agents[agent.GetName()] = agent
+	return sup, nil
+}
+
+// dependencies returns the supervisors of the agents that agent depends on, by name, nil for the ones
+// that are not started. They are looked for among agents, whose supervisors are sups, then among the running ones.
+func (m *MetaAgent) dependencies(agent Agent, agents []Agent, sups []supervisor.Supervisor) map[string]supervisor.Supervisor {
+	dependencies := make(map[string]supervisor.Supervisor)
+	for _, dependency := range m.config.DependsOn[agent.GetName()] {
+		dependencies[dependency] = m.supervisors[dependency]
+		for i := range agents {
+			if agents[i].GetName() == dependency {
+				dependencies[dependency] = sups[i]
+			}
+		}
+	}
+	return dependencies
+}
+
+// waitDependencies waits until the agents of dependencies are running.
+func (m *MetaAgent) waitDependencies(agent Agent, dependencies map[string]supervisor.Supervisor) error {
+	names := make([]string, 0, len(dependencies))
+	for name := range dependencies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := errors.New("it is not started")
+		if sup := dependencies[name]; sup != nil {
+			err = waitRunning(m.options.Clock, sup, dependencyTimeout)
+		}
 		if err != nil {
-			return err
+			return fmt.Errorf("cannot start agent '%s': dependency '%s' is not running: %w", agent.GetName(), name, err)
 		}
 	}
 	return nil
 }
+
+// launchAgent sets up and starts the supervisor of agent.
+func (m *MetaAgent) launchAgent(agent Agent) (supervisor.Supervisor, error) {
+	sup := agent.GetSupervisor()
+	if configurable, ok := sup.(supervisor.Configurable); ok {
+		options := m.options
+		options.Logger = m.options.Logger.With("agent.name", agent.GetName(), "agent.type", agent.GetType())
+		options.Metrics = m.agentMetrics(agent.GetName())
+		configurable.Configure(options)
+	}
+	if err := sup.Setup(); err != nil {
+		return nil, fmt.Errorf("cannot set up agent '%s': %w", agent.GetName(), err)
+	}
+	if err := sup.Start(); err != nil {
+		return nil, fmt.Errorf("cannot start agent '%s': %w", agent.GetName(), err)
+	}
+	return sup, nil
+}
+
+// waitRunning waits until the agent of sup is running. It returns why the agent is not, at once when the agent
+// is not coming up on its own. A collector waiting for its config is waited for until timeout.
+func waitRunning(clock supervisor.Clock, sup supervisor.Supervisor, timeout time.Duration) error {
+	deadline := clock.After(timeout)
+	for {
+		health := sup.Health()
+		switch health.State {
+		case supervisor.StateRunning:
+			return nil
+		case supervisor.StateStopped, supervisor.StateCrashLooping, supervisor.StateDegraded:
+			if health.LastError != "" {
+				return fmt.Errorf("it is %s: %s", health.State, health.LastError)
+			}
+			return fmt.Errorf("it is %s", health.State)
+		}
+		select {
+		case <-deadline:
+			return fmt.Errorf("it is still %s after %s", health.State, timeout)
+		case <-clock.After(dependencyCheckInterval):
+		}
+	}
+}
+
+// stopAgents stops the named agents, up to maxConcurrency at a time, and forgets them. An agent is only stopped
+// once the agents of the list that depend on it are. Every agent is stopped, even when some fail, and the errors
+// are returned.
+func (m *MetaAgent) stopAgents(ctx context.Context, names []string) []error {
+	index := make(map[string]int)
+	for i, name := range names {
+		index[name] = i
+	}
+	dependents := make([][]int, len(names))
+	for i, name := range names {
+		for _, dependency := range m.config.DependsOn[name] {
+			if j, found := index[dependency]; found {
+				dependents[j] = append(dependents[j], i)
+			}
+		}
+	}
+	stopErrs := parallel(m.config.MaxConcurrency, len(names), func(i int) []int {
+		return dependents[i]
+	}, func(i int) error {
+		sup, found := m.supervisors[names[i]]
+		if !found {
+			// Stopped on request meanwhile.
+			return nil
+		}
+		return sup.Stop(ctx)
+	})
+	var errs []error
+	for i, name := range names {
+		if stopErrs[i] != nil {
+			errs = append(errs, fmt.Errorf("cannot stop agent '%s': %w", name, stopErrs[i]))
+		}
+		delete(m.supervisors, name)
+		delete(m.agents, name)
+	}
+	return errs
+}
+
+// parallel calls fn with 0 to n-1, at most limit at a time, and returns the errors by index. fn is called
+// with i once it returned for every index of after(i), which must not have cycles. after may be nil.
+func parallel(limit int, n int, after func(i int) []int, fn func(i int) error) []error {
+	if limit <= 0 {
+		limit = 1
+	}
+	errs := make([]error, n)
+	done := make([]chan struct{}, n)
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer close(done[i])
+			if after != nil {
+				for _, j := range after(i) {
+					<-done[j]
+				}
+			}
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs[i] = fn(i)
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+// Stop stops every agent, up to maxConcurrency at a time. The agents still running when ctx is done
+// or when the shutdown timeout expires are killed. Every agent is stopped, even when some fail, and
+// the error joins all the failures.
+func (m *MetaAgent) Stop(ctx context.Context) error {
+	m.lifecycle.Lock()
+	defer m.lifecycle.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, m.config.ShutdownTimeout)
+	defer cancel()
+
+	names := make([]string, 0, len(m.supervisors))
+	for name := range m.supervisors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return errors.Join(append(m.stopAgents(ctx, names), m.unlockDataDir())...)
+}
+
+// Reload reads the config file again and applies it to the running agents: new agents are started,
+// removed ones are stopped and only the agents whose definition changed are restarted.
+// If the new config is invalid, it is rejected and the running agents are left untouched.
+func (m *MetaAgent) Reload() error {
+	if m.configPath == "" {
+		return errors.New("no config file to reload")
+	}
+	config, err := LoadConfig(m.configPath)
+	if err != nil {
+		return fmt.Errorf("new config rejected: %w", err)
+	}
+
+	m.lifecycle.Lock()
+	defer m.lifecycle.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.started() {
+		return ErrNotStarted
+	}
+	newAgents := make(map[string]Agent)
+	for _, agent := range config.Agents {
+		newAgents[agent.GetName()] = agent
+	}
+
+	// Stop the agents that are removed or changed, along with the agents that depend on them, before or after
+	// the reload, so they are started again once their dependencies are.
+	changed := make(map[string]bool)
+	for name, agent := range m.agents {
+		newAgent, found := newAgents[name]
+		if !found || !reflect.DeepEqual(agent, newAgent) {
+			changed[name] = true
+		}
+	}
+	for added := true; added; {
+		added = false
+		for name := range m.agents {
+			if changed[name] {
+				continue
+			}
+			for _, dependsOn := range [][]string{m.config.DependsOn[name], config.DependsOn[name]} {
+				for _, dependency := range dependsOn {
+					if changed[dependency] && !changed[name] {
+						changed[name] = true
+						added = true
+					}
+				}
+			}
+		}
+	}
+	var stopped []string
+	for name := range changed {
+		stopped = append(stopped, name)
+	}
+	sort.Strings(stopped)
+	ctx, cancel := context.WithTimeout(context.Background(), m.config.ShutdownTimeout)
+	defer cancel()
+	errs := m.stopAgents(ctx, stopped)
+	// Failed agents are tried again with their new definition.
+	m.failed = make(map[string]error)
+	m.config = *config
+
+	// Start the agents that are new or changed. The ones being started on request meanwhile are left to it.
+	var started []Agent
+	for _, agent := range config.Agents {
+		if _, found := m.agents[agent.GetName()]; !found && !m.starting[agent.GetName()] {
+			started = append(started, agent)
+		}
+	}
+	sups := make([]supervisor.Supervisor, len(started))
+	startErrs := m.startAgents(started, sups, func(i int) error {
+		var err error
+		sups[i], err = m.startAgent(started[i], started, sups)
+		return err
+	})
+	for i, agent := range started {
+		if startErrs[i] != nil {
+			errs = append(errs, startErrs[i])
+			m.failed[agent.GetName()] = startErrs[i]
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Health returns the health of every supervised agent, by agent name. The agents that could not be
+// started are reported as degraded.
+func (m *MetaAgent) Health() map[string]supervisor.Health {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	health := make(map[string]supervisor.Health)
+	for name, err := range m.failed {
+		health[name] = supervisor.Health{State: supervisor.StateDegraded, LastError: err.Error()}
+	}
+	for name, sup := range m.supervisors {
+		health[name] = sup.Health()
+	}
+	return health
+}
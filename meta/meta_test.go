@@ -0,0 +1,841 @@
+package meta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/open-telemetry/opamp-go/client"
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"superagent/control"
+	"superagent/events"
+	"superagent/supervisor"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func writeProcessConfig(t *testing.T, dir string, agents string) string {
+	return writeConfig(t, dir, "", agents)
+}
+
+func writeConfig(t *testing.T, dir string, settings string, agents string) string {
+	configPath := filepath.Join(dir, "meta.yaml")
+	config := fmt.Sprintf(`apiKey: key
+opampUrl: url
+dataDir: %s
+logDir: %s
+%sagents:
+%s`, filepath.Join(dir, "data"), filepath.Join(dir, "log"), settings, agents)
+	assert.Nil(t, os.WriteFile(configPath, []byte(config), 0644))
+	return configPath
+}
+
+const (
+	sleeperA = `  - type: process
+    name: a
+    executable: /bin/sleep
+    args: ["30"]
+`
+	sleeperB = `  - type: process
+    name: b
+    executable: /bin/sleep
+    args: ["30"]
+`
+	sleeperBChanged = `  - type: process
+    name: b
+    executable: /bin/sleep
+    args: ["60"]
+`
+	broken = `  - type: process
+    name: broken
+    executable: /no/such/executable
+`
+	sleeperC = `  - type: process
+    name: c
+    executable: /bin/sleep
+    args: ["30"]
+`
+)
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	configPath := writeProcessConfig(t, dir, sleeperA+sleeperB+sleeperC)
+	metaAgent, err := NewMetaAgent(configPath)
+	assert.Nil(t, err)
+	assert.Nil(t, metaAgent.Start())
+	defer metaAgent.Stop(context.Background())
+
+	a, b := metaAgent.supervisors["a"], metaAgent.supervisors["b"]
+	writeProcessConfig(t, dir, sleeperA+sleeperBChanged)
+	assert.Nil(t, metaAgent.Reload())
+
+	assert.Equal(t, 2, len(metaAgent.supervisors))
+	assert.Same(t, a, metaAgent.supervisors["a"], "unchanged agent must keep running")
+	assert.NotSame(t, b, metaAgent.supervisors["b"], "changed agent must be restarted")
+	assert.NotContains(t, metaAgent.supervisors, "c")
+	assert.True(t, metaAgent.Health()["b"].Healthy)
+}
+
+func TestReloadRestartsDependents(t *testing.T) {
+	dir := t.TempDir()
+	gateway := func(args string) string {
+		return fmt.Sprintf(`  - type: process
+    name: gateway
+    executable: /bin/sleep
+    args: [%s]
+`, args)
+	}
+	edge := `  - type: process
+    name: edge
+    executable: /bin/sleep
+    args: ["30"]
+    dependsOn: [gateway]
+`
+	configPath := writeProcessConfig(t, dir, gateway(`"30"`)+edge+sleeperA)
+	metaAgent, err := NewMetaAgent(configPath)
+	assert.Nil(t, err)
+	assert.Nil(t, metaAgent.Start())
+	defer metaAgent.Stop(context.Background())
+
+	edgeSup, a := metaAgent.supervisors["edge"], metaAgent.supervisors["a"]
+	writeProcessConfig(t, dir, gateway(`"60"`)+edge+sleeperA)
+	assert.Nil(t, metaAgent.Reload())
+
+	assert.Equal(t, 3, len(metaAgent.supervisors))
+	assert.NotSame(t, edgeSup, metaAgent.supervisors["edge"], "agent depending on a changed one must be restarted")
+	assert.Same(t, a, metaAgent.supervisors["a"])
+	assert.True(t, metaAgent.Health()["edge"].Healthy)
+}
+
+func TestReloadInvalidConfig(t *testing.T) {
+	dir := t.TempDir()
+	configPath := writeProcessConfig(t, dir, sleeperA)
+	metaAgent, err := NewMetaAgent(configPath)
+	assert.Nil(t, err)
+	assert.Nil(t, metaAgent.Start())
+	defer metaAgent.Stop(context.Background())
+
+	a := metaAgent.supervisors["a"]
+	writeProcessConfig(t, dir, sleeperA+sleeperA)
+	err = metaAgent.Reload()
+	assert.Contains(t, err.Error(), "new config rejected: ")
+	assert.Contains(t, err.Error(), "meta.yaml:11:11: agents[1].name: Agent 'a' defined multiple times")
+
+	assert.Equal(t, 1, len(metaAgent.supervisors))
+	assert.Same(t, a, metaAgent.supervisors["a"])
+}
+
+// childProcesses returns the PIDs of the processes started by the test that are still running.
+func childProcesses(t *testing.T) []int {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	assert.Nil(t, err)
+	var children []int
+	for _, stat := range stats {
+		b, err := os.ReadFile(stat)
+		if err != nil {
+			// The process is gone.
+			continue
+		}
+		// The command name is between parentheses and may contain spaces, the parent PID is the second field after it.
+		fields := strings.Fields(string(b[strings.LastIndexByte(string(b), ')')+1:]))
+		if ppid, _ := strconv.Atoi(fields[1]); ppid == os.Getpid() {
+			pid, _ := strconv.Atoi(filepath.Base(filepath.Dir(stat)))
+			children = append(children, pid)
+		}
+	}
+	return children
+}
+
+func TestStartRollback(t *testing.T) {
+	dir := t.TempDir()
+	configPath := writeProcessConfig(t, dir, sleeperA+broken+sleeperC)
+	metaAgent, err := NewMetaAgent(configPath)
+	assert.Nil(t, err)
+
+	err = metaAgent.Start()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "cannot start agent 'broken'")
+	assert.False(t, errors.Is(err, ErrDegraded))
+	assert.Empty(t, metaAgent.supervisors)
+	// The agent started before the failure was stopped.
+	assert.Empty(t, childProcesses(t))
+}
+
+func TestStartBestEffort(t *testing.T) {
+	dir := t.TempDir()
+	configPath := writeConfig(t, dir, "startupPolicy: best-effort\n", sleeperA+broken+sleeperC)
+	metaAgent, err := NewMetaAgent(configPath)
+	assert.Nil(t, err)
+
+	err = metaAgent.Start()
+	defer metaAgent.Stop(context.Background())
+	assert.True(t, errors.Is(err, ErrDegraded))
+	assert.Contains(t, err.Error(), "cannot start agent 'broken'")
+
+	health := metaAgent.Health()
+	assert.True(t, health["a"].Healthy)
+	assert.True(t, health["c"].Healthy)
+	assert.Equal(t, supervisor.StateDegraded, health["broken"].State)
+	assert.Contains(t, health["broken"].LastError, "cannot start agent 'broken'")
+}
+
+func TestStopDeadline(t *testing.T) {
+	dir := t.TempDir()
+	stubborn := func(name string) string {
+		return fmt.Sprintf(`  - type: process
+    name: %s
+    executable: /bin/sh
+    args: ["-c", "trap '' TERM; exec sleep 30"]
+`, name)
+	}
+	configPath := writeConfig(t, dir, "shutdownTimeout: 500ms\nmaxConcurrency: 2\n", stubborn("a")+stubborn("b"))
+	metaAgent, err := NewMetaAgent(configPath)
+	assert.Nil(t, err)
+	assert.Nil(t, metaAgent.Start())
+	// Let the shell set the trap up.
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	err = metaAgent.Stop(context.Background())
+	assert.Less(t, time.Since(start), 5*time.Second, "agents must be killed at the shutdown deadline")
+	// Both agents are stopped, and both failures are reported.
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "cannot stop agent 'a'")
+	assert.Contains(t, err.Error(), "cannot stop agent 'b'")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Empty(t, metaAgent.supervisors)
+	assert.Empty(t, childProcesses(t))
+}
+
+func TestParallel(t *testing.T) {
+	var running, maxRunning int32
+	errs := parallel(3, 10, nil, func(i int) error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		if i%2 == 1 {
+			return fmt.Errorf("error %d", i)
+		}
+		return nil
+	})
+
+	assert.Equal(t, int32(3), maxRunning)
+	assert.Equal(t, 10, len(errs))
+	assert.Nil(t, errs[0])
+	assert.EqualError(t, errs[9], "error 9")
+}
+
+func TestParallelOrder(t *testing.T) {
+	// 0 depends on 1 and 2, which depend on 3.
+	after := [][]int{{1, 2}, {3}, {3}, nil}
+	var mu sync.Mutex
+	var order []int
+	parallel(4, 4, func(i int) []int { return after[i] }, func(i int) error {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, i)
+		return nil
+	})
+
+	assert.Equal(t, 3, order[0])
+	assert.ElementsMatch(t, []int{1, 2}, order[1:3])
+	assert.Equal(t, 0, order[3])
+}
+
+func TestDependencyNotRunning(t *testing.T) {
+	dir := t.TempDir()
+	gateway := `  - type: process
+    name: gateway
+    executable: /no/such/executable
+`
+	edge := `  - type: process
+    name: edge
+    executable: /bin/sleep
+    args: ["30"]
+    dependsOn: [gateway]
+`
+	configPath := writeConfig(t, dir, "startupPolicy: best-effort\n", edge+gateway+sleeperA)
+	metaAgent, err := NewMetaAgent(configPath)
+	assert.Nil(t, err)
+
+	err = metaAgent.Start()
+	defer metaAgent.Stop(context.Background())
+	assert.True(t, errors.Is(err, ErrDegraded))
+	assert.Contains(t, err.Error(), "cannot start agent 'gateway'")
+	assert.Contains(t, err.Error(), "cannot start agent 'edge': dependency 'gateway' is not running")
+	assert.Equal(t, supervisor.StateDegraded, metaAgent.Health()["edge"].State)
+	assert.True(t, metaAgent.Health()["a"].Healthy)
+}
+
+func TestDependencyWaitingForConfig(t *testing.T) {
+	defer func(timeout time.Duration) { dependencyTimeout = timeout }(dependencyTimeout)
+	dependencyTimeout = 200 * time.Millisecond
+	dir := t.TempDir()
+	gateway := `  - type: otelcol
+    name: gateway
+    executable: /bin/sleep
+`
+	edge := `  - type: process
+    name: edge
+    executable: /bin/sleep
+    args: ["30"]
+    dependsOn: [gateway]
+`
+	metaAgent := New(loadTestConfig(t, dir, "startupPolicy: best-effort\n", gateway+edge), WithOpampClientFactory(func(logger types.Logger) client.OpAMPClient {
+		return &fakeOpampClient{}
+	}))
+
+	// Without a config yet, the gateway runs no process, so the edge is not started and nothing is ready.
+	err := metaAgent.Start()
+	defer metaAgent.Stop(context.Background())
+	assert.True(t, errors.Is(err, ErrDegraded))
+	assert.Contains(t, err.Error(), "dependency 'gateway' is not running: it is still waiting-for-config after 200ms")
+	assert.Equal(t, supervisor.StateWaitingForConfig, metaAgent.Health()["gateway"].State)
+	assert.False(t, metaAgent.Health()["gateway"].Healthy)
+	assert.Equal(t, supervisor.StateDegraded, metaAgent.Health()["edge"].State)
+	assert.False(t, metaAgent.Ready())
+}
+
+func TestDependencyStoppedFailsFast(t *testing.T) {
+	dir := t.TempDir()
+	gateway := `  - type: process
+    name: gateway
+    executable: /bin/sh
+    args: ["-c", "sleep 0.1; exit 3"]
+    restartPolicy:
+      mode: never
+`
+	edge := `  - type: process
+    name: edge
+    executable: /bin/sleep
+    args: ["30"]
+    dependsOn: [gateway]
+`
+	metaAgent := New(loadTestConfig(t, dir, "", gateway))
+	assert.Nil(t, metaAgent.Start())
+	defer metaAgent.Stop(context.Background())
+	assert.Eventually(t, func() bool {
+		return metaAgent.Health()["gateway"].State == supervisor.StateStopped
+	}, 5*time.Second, 10*time.Millisecond)
+
+	config := loadTestConfig(t, dir, "", gateway+edge)
+	metaAgent.config.Agents, metaAgent.config.DependsOn = config.Agents, config.DependsOn
+	start := time.Now()
+	err := metaAgent.StartAgent("edge")
+	assert.Less(t, time.Since(start), dependencyTimeout)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "dependency 'gateway' is not running: it is stopped")
+	assert.Contains(t, err.Error(), "exit code=3")
+}
+
+func TestStartWaitsUnlocked(t *testing.T) {
+	dir := t.TempDir()
+	gateway := `  - type: otelcol
+    name: gateway
+    executable: /bin/sleep
+`
+	edge := `  - type: process
+    name: edge
+    executable: /bin/sleep
+    args: ["30"]
+    dependsOn: [gateway]
+`
+	clock := &fakeClock{}
+	metaAgent := New(loadTestConfig(t, dir, "", gateway+edge), WithClock(clock), WithOpampClientFactory(func(logger types.Logger) client.OpAMPClient {
+		return &fakeOpampClient{}
+	}))
+	done := make(chan error)
+	go func() {
+		done <- metaAgent.Start()
+	}()
+	// Let Start wait for the gateway, which waits for its config, the agents can still be checked and
+	// controlled meanwhile.
+	assert.Eventually(t, func() bool {
+		return metaAgent.Health()["gateway"].State == supervisor.StateWaitingForConfig
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, metaAgent.Ready())
+	assert.ErrorIs(t, metaAgent.StartAgent("edge"), control.ErrAgentRunning)
+	// Time out the wait, once the edge waits.
+	var err error
+	assert.Eventually(t, func() bool {
+		clock.fire(dependencyTimeout)
+		select {
+		case err = <-done:
+			return true
+		default:
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "dependency 'gateway' is not running: it is still waiting-for-config after")
+	assert.Empty(t, metaAgent.supervisors)
+	assert.Empty(t, childProcesses(t))
+}
+
+func TestStartAgentWaitsUnlocked(t *testing.T) {
+	dir := t.TempDir()
+	gateway := `  - type: process
+    name: gateway
+    executable: /bin/false
+    restartPolicy:
+      initialBackoff: 1h
+`
+	edge := `  - type: process
+    name: edge
+    executable: /bin/sleep
+    args: ["30"]
+    dependsOn: [gateway]
+`
+	clock := &fakeClock{}
+	metaAgent := New(loadTestConfig(t, dir, "", gateway), WithClock(clock))
+	assert.Nil(t, metaAgent.Start())
+	defer metaAgent.Stop(context.Background())
+	// The gateway keeps waiting to be restarted.
+	assert.Eventually(t, func() bool {
+		return metaAgent.Health()["gateway"].State == supervisor.StateBackoff
+	}, 5*time.Second, 10*time.Millisecond)
+
+	config := loadTestConfig(t, dir, "", gateway+edge)
+	metaAgent.config.Agents, metaAgent.config.DependsOn = config.Agents, config.DependsOn
+	done := make(chan error)
+	go func() {
+		done <- metaAgent.StartAgent("edge")
+	}()
+	// Let StartAgent wait for the gateway, the agents can still be checked meanwhile.
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "backoff", metaAgent.Agents()[0].State)
+	// Time out the wait, but not the backoff of the gateway.
+	clock.fire(dependencyTimeout)
+	err := <-done
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "dependency 'gateway' is not running: it is still backoff after")
+}
+
+func TestStopInReverseOrder(t *testing.T) {
+	dir := t.TempDir()
+	orderFile := filepath.Join(dir, "order")
+	agent := func(name string, dependsOn string) string {
+		return fmt.Sprintf(`  - type: process
+    name: %s
+    executable: /bin/sh
+    args: ["-c", "trap 'echo %s >> %s; kill $!; exit 0' TERM; sleep 30 & wait"]
+    dependsOn: [%s]
+`, name, name, orderFile, dependsOn)
+	}
+	configPath := writeProcessConfig(t, dir, agent("edge", "gateway")+agent("gateway", "")+agent("edge2", "gateway"))
+	metaAgent, err := NewMetaAgent(configPath)
+	assert.Nil(t, err)
+	assert.Nil(t, metaAgent.Start())
+	// Let the shells set the traps up.
+	time.Sleep(200 * time.Millisecond)
+
+	assert.Nil(t, metaAgent.Stop(context.Background()))
+	order, err := os.ReadFile(orderFile)
+	assert.Nil(t, err)
+	lines := strings.Fields(string(order))
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, "gateway", lines[2])
+}
+
+// fakeClock is a real clock whose timers are fired by the test.
+type fakeClock struct {
+	mu     sync.Mutex
+	timers []fakeTimer
+}
+
+type fakeTimer struct {
+	d  time.Duration
+	ch chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.timers = append(c.timers, fakeTimer{d: d, ch: ch})
+	return ch
+}
+
+// fire fires the pending timers set for at most d.
+func (c *fakeClock) fire(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.d <= d {
+			timer.ch <- time.Now()
+		} else {
+			pending = append(pending, timer)
+		}
+	}
+	c.timers = pending
+}
+
+// fakeOpampClient records how the OpAMP client is used instead of connecting to a server.
+type fakeOpampClient struct {
+	client.OpAMPClient
+	mu        sync.Mutex
+	serverUrl string
+	stopped   bool
+}
+
+func (c *fakeOpampClient) Start(ctx context.Context, settings types.StartSettings) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.serverUrl = settings.OpAMPServerURL
+	return nil
+}
+
+func (c *fakeOpampClient) Stop(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+	return nil
+}
+
+func (c *fakeOpampClient) SetAgentDescription(descr *protobufs.AgentDescription) error {
+	return nil
+}
+
+func (c *fakeOpampClient) SetHealth(health *protobufs.AgentHealth) error {
+	return nil
+}
+
+func loadTestConfig(t *testing.T, dir string, settings string, agents string) *Meta {
+	config, err := LoadConfig(writeConfig(t, dir, settings, agents))
+	assert.Nil(t, err)
+	return config
+}
+
+func TestNewDefaults(t *testing.T) {
+	dir := t.TempDir()
+	config := loadTestConfig(t, dir, "", sleeperA+sleeperB)
+	config.StartupPolicy = ""
+	config.MaxConcurrency = 0
+	config.ShutdownTimeout = 0
+	config.Required = map[string]bool{"b": false}
+
+	metaAgent := New(config)
+	assert.Equal(t, StartupAllOrNothing, metaAgent.config.StartupPolicy)
+	assert.Equal(t, DefaultMaxConcurrency, metaAgent.config.MaxConcurrency)
+	assert.Equal(t, DefaultShutdownTimeout, metaAgent.config.ShutdownTimeout)
+	assert.Equal(t, map[string]bool{"a": true, "b": false}, metaAgent.config.Required)
+	// The config given to New is left as is.
+	assert.Equal(t, map[string]bool{"b": false}, config.Required)
+}
+
+func TestNewDependencyCycle(t *testing.T) {
+	dir := t.TempDir()
+	config := loadTestConfig(t, dir, "", sleeperA+sleeperB+sleeperC)
+	config.DependsOn = map[string][]string{"a": {"b"}, "b": {"a"}, "c": {"d"}}
+
+	metaAgent := New(config)
+	err := metaAgent.Start()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "dependency cycle: a -> b -> a")
+	assert.Contains(t, err.Error(), "agent 'c' depends on unknown agent 'd'")
+	assert.Empty(t, childProcesses(t))
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	core, logs := observer.New(zapcore.DebugLevel)
+	metaAgent := New(loadTestConfig(t, dir, "", sleeperA), WithLogger(zap.New(core)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- metaAgent.Run(ctx)
+	}()
+	assert.Eventually(t, func() bool {
+		return metaAgent.Health()["a"].Healthy
+	}, 5*time.Second, 10*time.Millisecond)
+	// The logs of the supervisors tell which agent they are about.
+	started := logs.FilterMessageSnippet("Agent process started").AllUntimed()
+	assert.Equal(t, 1, len(started))
+	assert.Equal(t, map[string]interface{}{"agent.name": "a", "agent.type": "process"}, started[0].ContextMap())
+
+	cancel()
+	assert.Nil(t, <-done)
+	assert.Empty(t, childProcesses(t))
+	assert.EqualError(t, metaAgent.Reload(), "no config file to reload")
+}
+
+func TestRunCrashLooping(t *testing.T) {
+	dir := t.TempDir()
+	crasher := `  - type: process
+    name: crasher
+    executable: /bin/false
+    restartPolicy:
+      initialBackoff: 1ms
+      maxRestarts: 1
+`
+	clock := &fakeClock{}
+	metaAgent := New(loadTestConfig(t, dir, "", sleeperA+crasher), WithClock(clock))
+
+	done := make(chan error)
+	go func() {
+		done <- metaAgent.Run(context.Background())
+	}()
+	// The crasher is only restarted when the clock says so.
+	assert.Eventually(t, func() bool {
+		return metaAgent.Health()["crasher"].State == supervisor.StateBackoff
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, supervisor.StateBackoff, metaAgent.Health()["crasher"].State)
+	assert.Eventually(t, func() bool {
+		clock.fire(time.Second)
+		return metaAgent.Health()["crasher"].State == supervisor.StateCrashLooping
+	}, 5*time.Second, 10*time.Millisecond)
+
+	clock.fire(healthCheckInterval)
+	err := <-done
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "agent 'crasher' is crash-looping")
+	assert.Empty(t, childProcesses(t))
+}
+
+func TestOpampClientFactory(t *testing.T) {
+	dir := t.TempDir()
+	collector := `  - type: otelcol
+    name: collector
+    executable: /bin/sleep
+`
+	fake := &fakeOpampClient{}
+	metaAgent := New(loadTestConfig(t, dir, "", collector), WithOpampClientFactory(func(logger types.Logger) client.OpAMPClient {
+		return fake
+	}))
+
+	assert.Nil(t, metaAgent.Start())
+	assert.Equal(t, "url", fake.serverUrl)
+	assert.Nil(t, metaAgent.Stop(context.Background()))
+	assert.True(t, fake.stopped)
+}
+
+func TestControlAgents(t *testing.T) {
+	dir := t.TempDir()
+	metaAgent := New(loadTestConfig(t, dir, "", sleeperA+sleeperB))
+	assert.Nil(t, metaAgent.Start())
+	defer metaAgent.Stop(context.Background())
+
+	assert.Nil(t, metaAgent.StopAgent(context.Background(), "a"))
+	assert.ErrorIs(t, metaAgent.StopAgent(context.Background(), "a"), control.ErrAgentNotRunning)
+	assert.ErrorIs(t, metaAgent.StartAgent("unknown"), control.ErrUnknownAgent)
+	assert.Equal(t, control.Status{Healthy: false, Agents: 2, RunningAgents: 1}, metaAgent.Status())
+
+	agents := metaAgent.Agents()
+	assert.Equal(t, "a", agents[0].Name)
+	assert.Equal(t, "stopped", agents[0].State)
+	assert.Equal(t, "running", agents[1].State)
+
+	assert.Nil(t, metaAgent.StartAgent("a"))
+	assert.ErrorIs(t, metaAgent.StartAgent("a"), control.ErrAgentRunning)
+	b := metaAgent.supervisors["b"]
+	pid := b.Status().Pid
+	assert.Nil(t, metaAgent.RestartAgent(context.Background(), "b"))
+	assert.Same(t, b, metaAgent.supervisors["b"])
+	assert.NotEqual(t, pid, b.Status().Pid)
+	assert.Equal(t, control.Status{Healthy: true, Agents: 2, RunningAgents: 2}, metaAgent.Status())
+
+	_, err := metaAgent.EffectiveConfig("a")
+	assert.ErrorIs(t, err, control.ErrUnsupported)
+}
+
+func TestControlAgentsUnlocked(t *testing.T) {
+	dir := t.TempDir()
+	slow := `  - type: process
+    name: a
+    executable: /bin/sh
+    args: ["-c", "trap 'kill $!; sleep 0.4; exit 0' TERM; sleep 30 & wait"]
+`
+	metaAgent := New(loadTestConfig(t, dir, "", slow))
+	assert.Nil(t, metaAgent.Start())
+	defer metaAgent.Stop(context.Background())
+
+	for _, action := range []func() error{
+		func() error { return metaAgent.RestartAgent(context.Background(), "a") },
+		func() error { return metaAgent.StopAgent(context.Background(), "a") },
+	} {
+		// Let the shell set the trap up.
+		time.Sleep(200 * time.Millisecond)
+		done := make(chan error)
+		go func() {
+			done <- action()
+		}()
+		// The agents can be checked and controlled while the agent takes its time to stop.
+		time.Sleep(100 * time.Millisecond)
+		start := time.Now()
+		assert.Len(t, metaAgent.Agents(), 1)
+		assert.ErrorIs(t, metaAgent.StartAgent("a"), control.ErrAgentRunning)
+		assert.Less(t, time.Since(start), 100*time.Millisecond)
+		assert.Nil(t, <-done)
+	}
+	assert.Empty(t, metaAgent.supervisors)
+}
+
+func TestControlAgentsNotStarted(t *testing.T) {
+	dir := t.TempDir()
+	metaAgent := New(loadTestConfig(t, dir, "", sleeperA))
+	assert.ErrorIs(t, metaAgent.StartAgent("a"), ErrNotStarted)
+	assert.ErrorIs(t, metaAgent.RestartAgent(context.Background(), "a"), ErrNotStarted)
+	assert.Empty(t, childProcesses(t))
+
+	assert.Nil(t, metaAgent.Start())
+	assert.Nil(t, metaAgent.Stop(context.Background()))
+	assert.ErrorIs(t, metaAgent.StartAgent("a"), ErrNotStarted)
+	assert.Empty(t, childProcesses(t))
+}
+
+func TestRunControlSocket(t *testing.T) {
+	dir := t.TempDir()
+	metaAgent := New(loadTestConfig(t, dir, "", sleeperA))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- metaAgent.Run(ctx)
+	}()
+
+	client := control.NewClient(ControlSocketPath(filepath.Join(dir, "data")))
+	assert.Eventually(t, func() bool {
+		status, err := client.Status()
+		return err == nil && status.RunningAgents == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.Nil(t, <-done)
+	_, err := client.Status()
+	assert.NotNil(t, err)
+}
+
+func TestAgentsStatus(t *testing.T) {
+	dir := t.TempDir()
+	optional := `  - type: process
+    name: optional
+    executable: /no/such/executable
+    required: false
+`
+	metaAgent := New(loadTestConfig(t, dir, "startupPolicy: best-effort\n", sleeperA+optional))
+	assert.True(t, errors.Is(metaAgent.Start(), ErrDegraded))
+	defer metaAgent.Stop(context.Background())
+
+	agents := metaAgent.Agents()
+	assert.True(t, agents[0].Required)
+	assert.NotZero(t, agents[0].Pid)
+	assert.Equal(t, 0, agents[0].Restarts)
+	assert.Empty(t, agents[0].OpampConnection)
+	assert.False(t, agents[1].Required)
+	assert.Equal(t, "degraded", agents[1].State)
+	// The agent that failed is not required.
+	assert.True(t, metaAgent.Ready())
+
+	assert.Nil(t, metaAgent.StopAgent(context.Background(), "a"))
+	assert.False(t, metaAgent.Ready())
+}
+
+func TestRunHTTPAddressInUse(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+
+	dir := t.TempDir()
+	metaAgent := New(loadTestConfig(t, dir, fmt.Sprintf("http:\n  address: %s\n", listener.Addr()), sleeperA))
+	err = metaAgent.Run(context.Background())
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "cannot serve the health endpoints")
+	assert.Empty(t, childProcesses(t))
+}
+
+func TestMetrics(t *testing.T) {
+	dir := t.TempDir()
+	crasher := `  - type: process
+    name: crasher
+    executable: /bin/false
+    restartPolicy:
+      initialBackoff: 1ms
+      maxRestarts: 3
+`
+	metaAgent := New(loadTestConfig(t, dir, "", sleeperA+crasher))
+	assert.Nil(t, metaAgent.Start())
+	defer metaAgent.Stop(context.Background())
+	assert.Eventually(t, func() bool {
+		return metaAgent.Health()["crasher"].State == supervisor.StateCrashLooping
+	}, 5*time.Second, 10*time.Millisecond)
+	// Exits asked for are not unexpected, and the metrics outlive the supervisor.
+	assert.Nil(t, metaAgent.RestartAgent(context.Background(), "a"))
+
+	var b strings.Builder
+	assert.Nil(t, metaAgent.WriteMetrics(&b))
+	out := b.String()
+	assert.Contains(t, out, `superagent_agent_restarts_total{agent="crasher",type="process"} 3`+"\n")
+	assert.Contains(t, out, `superagent_agent_unexpected_exits_total{agent="crasher",type="process"} 4`+"\n")
+	assert.Contains(t, out, `superagent_agent_unexpected_exits_total{agent="a",type="process"} 0`+"\n")
+	assert.Contains(t, out, `superagent_agent_uptime_seconds{agent="crasher",type="process"} 0`+"\n")
+}
+
+func TestEvents(t *testing.T) {
+	dir := t.TempDir()
+	crasher := `  - type: process
+    name: crasher
+    executable: /bin/false
+    restartPolicy:
+      initialBackoff: 1ms
+      maxRestarts: 1
+`
+	metaAgent := New(loadTestConfig(t, dir, "", crasher))
+	subscription := metaAgent.Subscribe(16)
+	defer subscription.Close()
+	assert.Nil(t, metaAgent.Start())
+	defer metaAgent.Stop(context.Background())
+
+	var seen []events.Type
+	for len(seen) < 6 {
+		select {
+		case event := <-subscription.Events():
+			assert.Equal(t, "crasher", event.Agent)
+			assert.False(t, event.Time.IsZero())
+			seen = append(seen, event.Type)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("missing events after %v", seen)
+		}
+	}
+	assert.Equal(t, []events.Type{events.AgentStarted, events.AgentExited, events.RestartScheduled,
+		events.AgentStarted, events.AgentExited, events.CrashLoopDetected}, seen)
+	assert.Equal(t, uint64(0), subscription.Dropped())
+}
+
+func TestDataDirLock(t *testing.T) {
+	dir := t.TempDir()
+	config := loadTestConfig(t, dir, "", sleeperA)
+	first := New(config)
+	assert.Nil(t, first.Start())
+
+	second := New(config)
+	err := second.Start()
+	assert.ErrorIs(t, err, supervisor.ErrDirLocked)
+	assert.Equal(t, 1, len(childProcesses(t)))
+
+	assert.Nil(t, first.Stop(context.Background()))
+	assert.Nil(t, second.Start())
+	assert.Nil(t, second.Stop(context.Background()))
+}
@@ -0,0 +1,34 @@
+package meta
+
+import (
+	"io"
+	"superagent/metrics"
+	"superagent/supervisor"
+)
+
+// agentMetrics returns the metrics of the agent called name, created on first use.
+func (m *MetaAgent) agentMetrics(name string) *metrics.Agent {
+	m.metricsMu.Lock()
+	defer m.metricsMu.Unlock()
+	if m.metrics == nil {
+		m.metrics = make(map[string]*metrics.Agent)
+	}
+	if _, found := m.metrics[name]; !found {
+		m.metrics[name] = metrics.NewAgent()
+	}
+	return m.metrics[name]
+}
+
+// WriteMetrics writes the metrics of every agent of the config in the Prometheus text format.
+func (m *MetaAgent) WriteMetrics(w io.Writer) error {
+	now := m.options.Clock.Now()
+	var samples []metrics.Sample
+	for _, agent := range m.Agents() {
+		sample := metrics.Sample{Name: agent.Name, Type: agent.Type, Metrics: m.agentMetrics(agent.Name)}
+		if agent.State == string(supervisor.StateRunning) && !agent.StartTime.IsZero() {
+			sample.Uptime = now.Sub(agent.StartTime)
+		}
+		samples = append(samples, sample)
+	}
+	return metrics.WritePrometheus(w, samples)
+}
@@ -0,0 +1,217 @@
+package meta
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"superagent/supervisor"
+	"sync"
+	"time"
+)
+
+// Globals are the settings of meta.yaml that apply to every agent.
+type Globals struct {
+	ApiKey      string
+	OpampUrl    string
+	DataDir     string
+	LogDir      string
+	LogRotation supervisor.LogRotation
+}
+
+// AgentBlock is the definition of one agent in meta.yaml. It always has a name and a type.
+// Its accessors report the problems they find, with their position in the file, and return zero values.
+type AgentBlock struct {
+	fields    *mapping
+	nameValue value
+	name      string
+	agentType string
+	dependsOn []value
+	required  bool
+}
+
+// AgentFactory builds an Agent of a given type from its definition in meta.yaml.
+// It should read every parameter it supports before returning, even when some have problems:
+// the parameters that were not read are reported as unknown.
+// It returns Err() if the block has problems, or an error of its own.
+type AgentFactory func(block *AgentBlock, globals Globals) (Agent, error)
+
+var (
+	agentTypesMu sync.RWMutex
+	agentTypes   = make(map[string]AgentFactory)
+)
+
+// RegisterAgentType makes an agent type available in meta.yaml.
+// It panics if the factory is nil or if the type is registered twice.
+func RegisterAgentType(name string, factory AgentFactory) {
+	agentTypesMu.Lock()
+	defer agentTypesMu.Unlock()
+	if factory == nil {
+		panic("meta: RegisterAgentType factory is nil")
+	}
+	if _, found := agentTypes[name]; found {
+		panic("meta: RegisterAgentType called twice for agent type " + name)
+	}
+	agentTypes[name] = factory
+}
+
+func getAgentFactory(name string) (AgentFactory, bool) {
+	agentTypesMu.RLock()
+	defer agentTypesMu.RUnlock()
+	factory, found := agentTypes[name]
+	return factory, found
+}
+
+func (b *AgentBlock) Name() string {
+	return b.name
+}
+
+func (b *AgentBlock) Type() string {
+	return b.agentType
+}
+
+// Err returns the problems found in the block so far, or nil.
+func (b *AgentBlock) Err() error {
+	var errs []error
+	for _, err := range b.fields.d.errs {
+		if configErr, ok := err.(*ConfigError); ok && strings.HasPrefix(configErr.Path, b.fields.path+".") {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Errorf reports a problem with the parameter named key.
+func (b *AgentBlock) Errorf(key string, format string, args ...interface{}) {
+	b.fields.d.errs = append(b.fields.d.errs, b.newError(key, format, args...))
+}
+
+func (b *AgentBlock) newError(key string, format string, args ...interface{}) *ConfigError {
+	if v, found := b.fields.values[key]; found {
+		return v.d.newError(v.node, v.path, format, args...)
+	}
+	return b.fields.d.newError(b.fields.node, b.fields.childPath(key), format, args...)
+}
+
+// String returns the string parameter named key, and reports it if it is not defined.
+func (b *AgentBlock) String(key string) string {
+	v, found := b.fields.Require(key, "No %s defined", key)
+	if !found {
+		return ""
+	}
+	s, _ := v.String()
+	return s
+}
+
+// OptionalString returns the string parameter named key, or an empty string if it is not defined.
+func (b *AgentBlock) OptionalString(key string) string {
+	v, found := b.fields.Get(key)
+	if !found {
+		return ""
+	}
+	s, _ := v.String()
+	return s
+}
+
+// Int returns the integer parameter named key, or defaultValue if it is not defined.
+func (b *AgentBlock) Int(key string, defaultValue int) int {
+	v, found := b.fields.Get(key)
+	if !found {
+		return defaultValue
+	}
+	i, _ := v.Int()
+	return i
+}
+
+// Bool returns the boolean parameter named key, or defaultValue if it is not defined.
+func (b *AgentBlock) Bool(key string, defaultValue bool) bool {
+	v, found := b.fields.Get(key)
+	if !found {
+		return defaultValue
+	}
+	bv, _ := v.Bool()
+	return bv
+}
+
+// Duration returns the duration parameter named key, such as '5s', or defaultValue if it is not defined.
+func (b *AgentBlock) Duration(key string, defaultValue time.Duration) time.Duration {
+	v, found := b.fields.Get(key)
+	if !found {
+		return defaultValue
+	}
+	d, _ := v.Duration()
+	return d
+}
+
+// StringList returns the list of strings named key, or nil if it is not defined.
+func (b *AgentBlock) StringList(key string) []string {
+	v, found := b.fields.Get(key)
+	if !found {
+		return nil
+	}
+	items, ok := v.Sequence()
+	if !ok {
+		return nil
+	}
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.String(); ok {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// StringMap returns the map of strings named key, or nil if it is not defined.
+func (b *AgentBlock) StringMap(key string) map[string]string {
+	v, found := b.fields.Get(key)
+	if !found {
+		return nil
+	}
+	entries, ok := v.Mapping()
+	if !ok {
+		return nil
+	}
+	m := make(map[string]string, len(entries.keys))
+	for _, name := range entries.keys {
+		value, _ := entries.Get(name)
+		if s, ok := value.String(); ok {
+			m[name] = s
+		}
+	}
+	return m
+}
+
+// Env returns the map of environment variables named key as a sorted list of KEY=value,
+// or nil if it is not defined.
+func (b *AgentBlock) Env(key string) []string {
+	vars := b.StringMap(key)
+	if vars == nil {
+		return nil
+	}
+	env := make([]string, 0, len(vars))
+	for name, value := range vars {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// RestartPolicy returns the restart policy of the agent, with the defaults for what is not defined.
+func (b *AgentBlock) RestartPolicy() supervisor.RestartPolicy {
+	restartPolicy := supervisor.DefaultRestartPolicy()
+	if v, found := b.fields.Get("restartPolicy"); found {
+		restartPolicy = parseRestartPolicy(v, restartPolicy)
+	}
+	return restartPolicy
+}
+
+// DataDir returns the directory where the agent keeps its data.
+func (b *AgentBlock) DataDir(globals Globals) string {
+	return filepath.Join(globals.DataDir, b.Type(), b.Name())
+}
+
+// LogDir returns the directory where the agent output is written.
+func (b *AgentBlock) LogDir(globals Globals) string {
+	return filepath.Join(globals.LogDir, b.Type(), b.Name())
+}
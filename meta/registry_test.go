@@ -0,0 +1,70 @@
+package meta
+
+import (
+	"github.com/stretchr/testify/assert"
+	"superagent/supervisor"
+	"testing"
+	"time"
+)
+
+type customAgent struct {
+	name      string
+	flavor    string
+	scoops    int
+	frozen    bool
+	meltAfter time.Duration
+	cone      bool
+	dataDir   string
+}
+
+func (a *customAgent) GetType() string {
+	return "custom"
+}
+
+func (a *customAgent) GetName() string {
+	return a.name
+}
+
+func (a *customAgent) GetSupervisor() supervisor.Supervisor {
+	return nil
+}
+
+func TestRegisterAgentType(t *testing.T) {
+	RegisterAgentType("custom", func(block *AgentBlock, globals Globals) (Agent, error) {
+		agent := &customAgent{
+			name:      block.Name(),
+			flavor:    block.String("flavor"),
+			scoops:    block.Int("scoops", 1),
+			frozen:    block.Bool("frozen", false),
+			meltAfter: block.Duration("meltAfter", time.Minute),
+			cone:      block.Bool("cone", true),
+			dataDir:   block.DataDir(globals),
+		}
+		if err := block.Err(); err != nil {
+			return nil, err
+		}
+		return agent, nil
+	})
+	t.Cleanup(func() {
+		agentTypesMu.Lock()
+		defer agentTypesMu.Unlock()
+		delete(agentTypes, "custom")
+	})
+
+	meta, err := LoadConfig("testdata/meta_config_custom_agent_type.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, len(meta.Agents), 1)
+
+	agent := meta.Agents[0].(*customAgent)
+	assert.Equal(t, agent.GetName(), "custom-name")
+	assert.Equal(t, agent.flavor, "vanilla")
+	assert.Equal(t, agent.scoops, 2)
+	assert.True(t, agent.frozen)
+	assert.Equal(t, agent.meltAfter, 5*time.Minute)
+	assert.True(t, agent.cone)
+	assert.Equal(t, agent.dataDir, "/etc/newrelic/meta/custom/custom-name")
+
+	assert.Panics(t, func() {
+		RegisterAgentType("custom", newOtelCol)
+	})
+}
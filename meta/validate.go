@@ -0,0 +1,92 @@
+package meta
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// ExecutableAgent is implemented by the agents that run an executable, so Validate can check it.
+type ExecutableAgent interface {
+	GetExecutable() string
+}
+
+// Validate checks the config file at path without starting anything. It returns every problem found,
+// from parsing errors to executables that cannot be run and directories that cannot be written.
+func Validate(path string) []error {
+	config, errs := loadConfig(path)
+	if config == nil {
+		return errs
+	}
+
+	for _, key := range []string{"dataDir", "logDir"} {
+		v, found := config.settings[key]
+		if !found {
+			continue
+		}
+		dir, _ := expand(v.Raw())
+		if dir == "" {
+			continue
+		}
+		if err := checkWritableDir(dir); err != nil {
+			errs = append(errs, v.d.newError(v.node, v.path, "Directory '%s' is not writable: %s", v.Raw(), rootCause(err)))
+		}
+	}
+	for _, agent := range config.meta.Agents {
+		executableAgent, ok := agent.(ExecutableAgent)
+		if !ok {
+			continue
+		}
+		if _, err := exec.LookPath(executableAgent.GetExecutable()); err != nil {
+			block := config.blocks[agent.GetName()]
+			raw := block.fields.values["executable"].Raw()
+			errs = append(errs, block.newError("executable", "Cannot run executable '%s': %s", raw, rootCause(err)))
+		}
+	}
+	sortErrors(errs, config.files)
+	return errs
+}
+
+// rootCause returns the innermost error of err. The outer ones quote the paths, which may have been
+// resolved from references to secrets.
+func rootCause(err error) error {
+	for {
+		wrapped := errors.Unwrap(err)
+		if wrapped == nil {
+			return err
+		}
+		err = wrapped
+	}
+}
+
+// checkWritableDir checks that dir can be written to, or created if it does not exist yet.
+func checkWritableDir(dir string) error {
+	existing := dir
+	for {
+		info, err := os.Stat(existing)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("%w: %s", syscall.ENOTDIR, existing)
+			}
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return err
+		}
+		existing = parent
+	}
+
+	f, err := os.CreateTemp(existing, ".superagent-validate-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
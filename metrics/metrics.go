@@ -0,0 +1,95 @@
+// Package metrics holds the metrics the meta agent keeps about the agents it supervises.
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter is a value that only goes up.
+type Counter struct {
+	v atomic.Int64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Value() int64 {
+	return c.v.Load()
+}
+
+// DefaultBuckets are the upper bounds, in seconds, of the buckets of the config apply latency histogram.
+var DefaultBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30}
+
+// Histogram counts observed durations in buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	// Number of observations in each bucket, not cumulated.
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	seconds := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// HistogramSnapshot is the state of a histogram at a point in time.
+type HistogramSnapshot struct {
+	Buckets []float64
+	// Number of observations less than or equal to each bucket bound.
+	Cumulative []uint64
+	Sum        float64
+	Count      uint64
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	snapshot := HistogramSnapshot{Buckets: h.buckets, Cumulative: make([]uint64, len(h.buckets)), Sum: h.sum, Count: h.count}
+	var total uint64
+	for i, count := range h.counts {
+		total += count
+		snapshot.Cumulative[i] = total
+	}
+	return snapshot
+}
+
+// Agent holds the metrics of one agent. They outlive its supervisor, so they are not reset when the agent
+// is restarted from the control socket.
+type Agent struct {
+	// Restarts after the agent process exited on its own.
+	Restarts Counter
+	// Exits of the agent process that were not asked for.
+	UnexpectedExits Counter
+
+	RemoteConfigsReceived Counter
+	RemoteConfigsApplied  Counter
+	RemoteConfigsFailed   Counter
+	// Time from receiving a remote config to running the agent with it.
+	ConfigApplyLatency *Histogram
+
+	OpampConnectFailures Counter
+	OpampServerErrors    Counter
+}
+
+func NewAgent() *Agent {
+	return &Agent{ConfigApplyLatency: NewHistogram(DefaultBuckets)}
+}
@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram([]float64{0.1, 1})
+	h.Observe(50 * time.Millisecond)
+	h.Observe(500 * time.Millisecond)
+	h.Observe(2 * time.Second)
+
+	snapshot := h.Snapshot()
+	assert.Equal(t, []uint64{1, 2}, snapshot.Cumulative)
+	assert.Equal(t, uint64(3), snapshot.Count)
+	assert.InDelta(t, 2.55, snapshot.Sum, 1e-9)
+}
+
+func TestWritePrometheus(t *testing.T) {
+	gateway := NewAgent()
+	gateway.Restarts.Inc()
+	gateway.Restarts.Inc()
+	gateway.OpampConnectFailures.Inc()
+	gateway.ConfigApplyLatency.Observe(200 * time.Millisecond)
+
+	var b bytes.Buffer
+	assert.Nil(t, WritePrometheus(&b, []Sample{
+		{Name: "gateway", Type: "otelcol", Metrics: gateway, Uptime: 90 * time.Second},
+		{Name: `odd"name`, Type: "process", Metrics: NewAgent()},
+	}))
+	out := b.String()
+
+	assert.Contains(t, out, "# TYPE superagent_agent_restarts_total counter\n")
+	assert.Contains(t, out, `superagent_agent_restarts_total{agent="gateway",type="otelcol"} 2`+"\n")
+	assert.Contains(t, out, `superagent_agent_restarts_total{agent="odd\"name",type="process"} 0`+"\n")
+	assert.Contains(t, out, `superagent_opamp_connect_failures_total{agent="gateway",type="otelcol"} 1`+"\n")
+	assert.Contains(t, out, `superagent_agent_uptime_seconds{agent="gateway",type="otelcol"} 90`+"\n")
+	assert.Contains(t, out, "# TYPE superagent_config_apply_duration_seconds histogram\n")
+	assert.Contains(t, out, `superagent_config_apply_duration_seconds_bucket{agent="gateway",type="otelcol",le="0.1"} 0`+"\n")
+	assert.Contains(t, out, `superagent_config_apply_duration_seconds_bucket{agent="gateway",type="otelcol",le="0.5"} 1`+"\n")
+	assert.Contains(t, out, `superagent_config_apply_duration_seconds_bucket{agent="gateway",type="otelcol",le="+Inf"} 1`+"\n")
+	assert.Contains(t, out, `superagent_config_apply_duration_seconds_count{agent="gateway",type="otelcol"} 1`+"\n")
+}
@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sample is the metrics of one agent at scrape time.
+type Sample struct {
+	Name    string
+	Type    string
+	Metrics *Agent
+	// Zero if the agent is not running.
+	Uptime time.Duration
+}
+
+type counterSeries struct {
+	name    string
+	help    string
+	counter func(m *Agent) *Counter
+}
+
+var counters = []counterSeries{
+	{"superagent_agent_restarts_total", "Restarts of the agent process after it exited on its own.", func(m *Agent) *Counter { return &m.Restarts }},
+	{"superagent_agent_unexpected_exits_total", "Exits of the agent process that were not asked for.", func(m *Agent) *Counter { return &m.UnexpectedExits }},
+	{"superagent_remote_configs_received_total", "Remote configs received from the OpAMP server.", func(m *Agent) *Counter { return &m.RemoteConfigsReceived }},
+	{"superagent_remote_configs_applied_total", "Remote configs applied.", func(m *Agent) *Counter { return &m.RemoteConfigsApplied }},
+	{"superagent_remote_configs_failed_total", "Remote configs that could not be applied.", func(m *Agent) *Counter { return &m.RemoteConfigsFailed }},
+	{"superagent_opamp_connect_failures_total", "Failed attempts to connect to the OpAMP server.", func(m *Agent) *Counter { return &m.OpampConnectFailures }},
+	{"superagent_opamp_server_errors_total", "Error responses of the OpAMP server.", func(m *Agent) *Counter { return &m.OpampServerErrors }},
+}
+
+// WritePrometheus writes the metrics of the agents in the Prometheus text exposition format.
+func WritePrometheus(w io.Writer, samples []Sample) error {
+	b := bufio.NewWriter(w)
+	for _, series := range counters {
+		writeHeader(b, series.name, series.help, "counter")
+		for _, sample := range samples {
+			fmt.Fprintf(b, "%s{%s} %d\n", series.name, labels(sample), series.counter(sample.Metrics).Value())
+		}
+	}
+
+	writeHeader(b, "superagent_agent_uptime_seconds", "Time since the agent process was started, zero if it is not running.", "gauge")
+	for _, sample := range samples {
+		fmt.Fprintf(b, "superagent_agent_uptime_seconds{%s} %s\n", labels(sample), formatFloat(sample.Uptime.Seconds()))
+	}
+
+	name := "superagent_config_apply_duration_seconds"
+	writeHeader(b, name, "Time from receiving a remote config to running the agent with it.", "histogram")
+	for _, sample := range samples {
+		snapshot := sample.Metrics.ConfigApplyLatency.Snapshot()
+		for i, bound := range snapshot.Buckets {
+			fmt.Fprintf(b, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels(sample), formatFloat(bound), snapshot.Cumulative[i])
+		}
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels(sample), snapshot.Count)
+		fmt.Fprintf(b, "%s_sum{%s} %s\n", name, labels(sample), formatFloat(snapshot.Sum))
+		fmt.Fprintf(b, "%s_count{%s} %d\n", name, labels(sample), snapshot.Count)
+	}
+	return b.Flush()
+}
+
+func writeHeader(w io.Writer, name string, help string, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func labels(sample Sample) string {
+	return fmt.Sprintf(`agent="%s",type="%s"`, escapeLabel(sample.Name), escapeLabel(sample.Type))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -2,16 +2,30 @@ package opamp
 
 import (
 	"context"
+	"github.com/oklog/ulid/v2"
 	"github.com/open-telemetry/opamp-go/client"
 	"github.com/open-telemetry/opamp-go/client/types"
 	"github.com/open-telemetry/opamp-go/protobufs"
 	"net/http"
+	"superagent/metrics"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Config struct {
 	OpampUrl string
 	ApiKey   string
+	// Extra headers of the requests to the server.
+	Headers map[string]string
+}
+
+// ClientFactory creates the OpAMP client that talks to the server.
+type ClientFactory func(logger types.Logger) client.OpAMPClient
+
+// NewHTTPClient is the default ClientFactory, it talks to the server over plain HTTP.
+func NewHTTPClient(logger types.Logger) client.OpAMPClient {
+	return client.NewHTTP(logger)
 }
 
 type Client struct {
@@ -19,6 +33,27 @@ type Client struct {
 	OpampClient client.OpAMPClient
 	Supervisor  *Supervisor
 	Logger      types.Logger
+	// Creates OpampClient, NewHTTPClient if nil.
+	NewClient ClientFactory
+	// Counts the connect failures and error responses, and is exported when the server asks for
+	// the own metrics. A new one is created if nil.
+	Metrics *metrics.Agent
+	// Called when the connection to the server is established, or an attempt fails after it was.
+	// err is the reason of the failure.
+	OnConnectionChange func(connected bool, err error)
+	// Status of the last remote config, reported as the client starts. Nil if no remote config was received.
+	RemoteConfigStatus *RemoteConfigStatus
+	// How often the own metrics are exported, DefaultOwnMetricsInterval if zero.
+	OwnMetricsInterval time.Duration
+
+	connected atomic.Bool
+	startTime time.Time
+	// Start time of the agent process, zero if it is not running.
+	agentStart   atomic.Value
+	ownMetricsMu sync.Mutex
+	ownMetrics   *ownMetricsExporter
+	// Whether the client is stopping, after which no exporter is installed.
+	ownMetricsStopped bool
 }
 
 type Supervisor interface {
@@ -36,20 +71,38 @@ func NewOpampClient(config Config, sup Supervisor, logger types.Logger) Client {
 }
 
 func (c *Client) StartOpAMP() error {
-	c.OpampClient = client.NewHTTP(c.Logger)
+	newClient := c.NewClient
+	if newClient == nil {
+		newClient = NewHTTPClient
+	}
+	c.OpampClient = newClient(c.Logger)
+	if c.Metrics == nil {
+		c.Metrics = metrics.NewAgent()
+	}
+	c.startTime = time.Now()
+
+	header := http.Header{}
+	header.Set("api-key", c.Config.ApiKey)
+	for name, value := range c.Config.Headers {
+		header.Set(name, value)
+	}
 
 	settings := types.StartSettings{
 		OpAMPServerURL: c.Config.OpampUrl,
 		InstanceUid:    (*c.Supervisor).GetAgentDescription().InstanceId.String(),
-		Header:         http.Header{"api-key": {c.Config.ApiKey}},
+		Header:         header,
 		Callbacks: types.CallbacksStruct{
 			OnConnectFunc: func() {
+				c.setConnected(true, nil)
 				c.Logger.Debugf("Connected to the server.")
 			},
 			OnConnectFailedFunc: func(err error) {
+				c.setConnected(false, err)
+				c.Metrics.OpampConnectFailures.Inc()
 				c.Logger.Errorf("Failed to connect to the server: %v", err)
 			},
 			OnErrorFunc: func(err *protobufs.ServerErrorResponse) {
+				c.Metrics.OpampServerErrors.Inc()
 				c.Logger.Errorf("Server returned an error response: %v", err.ErrorMessage)
 			},
 			GetEffectiveConfigFunc: func(ctx context.Context) (*protobufs.EffectiveConfig, error) {
@@ -63,6 +116,9 @@ func (c *Client) StartOpAMP() error {
 			protobufs.AgentCapabilities_AgentCapabilities_ReportsOwnMetrics |
 			protobufs.AgentCapabilities_AgentCapabilities_ReportsHealth,
 	}
+	if c.RemoteConfigStatus != nil {
+		settings.RemoteConfigStatus = remoteConfigStatus(*c.RemoteConfigStatus)
+	}
 	err := c.OpampClient.SetAgentDescription(c.createAgentDescription())
 	if err != nil {
 		return err
@@ -85,10 +141,34 @@ func (c *Client) StartOpAMP() error {
 	return nil
 }
 
+func (c *Client) StopOpAMP(ctx context.Context) error {
+	c.Logger.Debugf("Stopping OpAMP client...")
+	c.connected.Store(false)
+	c.stopOwnMetrics()
+	return c.OpampClient.Stop(ctx)
+}
+
+func (c *Client) setConnected(connected bool, err error) {
+	// The connection is considered down before the first attempt, so the first failure is not a change.
+	if c.connected.Swap(connected) != connected && c.OnConnectionChange != nil {
+		c.OnConnectionChange(connected, err)
+	}
+}
+
+// Connected tells whether the last attempt to reach the server succeeded.
+func (c *Client) Connected() bool {
+	return c.connected.Load()
+}
+
+func (c *Client) agentStartTime() time.Time {
+	startTime, _ := c.agentStart.Load().(time.Time)
+	return startTime
+}
+
 func (c *Client) createAgentDescription() *protobufs.AgentDescription {
 	agent := (*c.Supervisor).GetAgentDescription()
 
-	return &protobufs.AgentDescription{
+	description := &protobufs.AgentDescription{
 		IdentifyingAttributes: []*protobufs.KeyValue{
 			keyVal("service.name", agent.Service.Name),
 			keyVal("service.version", agent.Service.Version),
@@ -101,6 +181,12 @@ func (c *Client) createAgentDescription() *protobufs.AgentDescription {
 			keyVal("host.name", agent.Host.Name),
 		},
 	}
+	if agent.ReplacedInstanceId != (ulid.ULID{}) {
+		// Tells the server that the agent is a clone, and which agent it was cloned from.
+		description.NonIdentifyingAttributes = append(description.NonIdentifyingAttributes,
+			keyVal("service.instance.replaced_id", agent.ReplacedInstanceId.String()))
+	}
+	return description
 }
 
 func keyVal(key, val string) *protobufs.KeyValue {
@@ -143,9 +229,13 @@ func (c *Client) onMessage(ctx context.Context, msg *types.MessageData) {
 		}
 		(*c.Supervisor).ApplyRemoteConfig(ctx, remoteConfig)
 	}
+	if msg.OwnMetricsConnSettings != nil {
+		c.onOwnMetricsSettings(msg.OwnMetricsConnSettings)
+	}
 }
 
 func (c *Client) SetUnhealthy(lastError string) {
+	c.agentStart.Store(time.Time{})
 	err := c.OpampClient.SetHealth(&protobufs.AgentHealth{Healthy: false, LastError: lastError})
 	if err != nil {
 		c.Logger.Errorf("cannot set health %v", err)
@@ -153,28 +243,33 @@ func (c *Client) SetUnhealthy(lastError string) {
 }
 
 func (c *Client) SetHealthy(startTime time.Time) {
+	c.agentStart.Store(startTime)
 	err := c.OpampClient.SetHealth(&protobufs.AgentHealth{Healthy: true, StartTimeUnixNano: uint64(startTime.UnixNano())})
 	if err != nil {
 		c.Logger.Errorf("cannot set health %v", err)
 	}
 }
 
+func remoteConfigStatus(status RemoteConfigStatus) *protobufs.RemoteConfigStatus {
+	msg := &protobufs.RemoteConfigStatus{
+		LastRemoteConfigHash: []byte(status.Hash),
+		Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+	}
+	if !status.Applied {
+		msg.Status, msg.ErrorMessage = protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED, status.ErrorMessage
+	}
+	return msg
+}
+
 func (c *Client) SetRemoteConfigError(lastHash string, errorMessage string) {
-	err := c.OpampClient.SetRemoteConfigStatus(&protobufs.RemoteConfigStatus{
-		LastRemoteConfigHash: []byte(lastHash),
-		Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED,
-		ErrorMessage:         errorMessage,
-	})
+	err := c.OpampClient.SetRemoteConfigStatus(remoteConfigStatus(RemoteConfigStatus{Hash: lastHash, ErrorMessage: errorMessage}))
 	if err != nil {
 		c.Logger.Errorf("cannot set remote config error %v", err)
 	}
 }
 
 func (c *Client) SetRemoteConfigApplied(lastHash string) {
-	err := c.OpampClient.SetRemoteConfigStatus(&protobufs.RemoteConfigStatus{
-		LastRemoteConfigHash: []byte(lastHash),
-		Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
-	})
+	err := c.OpampClient.SetRemoteConfigStatus(remoteConfigStatus(RemoteConfigStatus{Hash: lastHash, Applied: true}))
 	if err != nil {
 		c.Logger.Errorf("cannot set remote config status %v", err)
 	}
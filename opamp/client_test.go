@@ -0,0 +1,47 @@
+package opamp
+
+import (
+	"errors"
+	"github.com/oklog/ulid/v2"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestConnectionChanges(t *testing.T) {
+	client := NewOpampClient(Config{}, testSupervisor{}, testLogger{t})
+	var changes []bool
+	client.OnConnectionChange = func(connected bool, err error) {
+		changes = append(changes, connected)
+	}
+
+	// Failing to connect in the first place is not a disconnection.
+	client.setConnected(false, errors.New("refused"))
+	client.setConnected(true, nil)
+	client.setConnected(true, nil)
+	client.setConnected(false, errors.New("reset"))
+	client.setConnected(false, errors.New("refused"))
+	assert.Equal(t, []bool{true, false}, changes)
+	assert.False(t, client.Connected())
+}
+
+type clonedSupervisor struct {
+	testSupervisor
+}
+
+func (clonedSupervisor) GetAgentDescription() Agent {
+	return Agent{InstanceId: ulid.MustParse("01GTEVKE9Q06AFVGQT5ZYC0GEK"), ReplacedInstanceId: ulid.MustParse("01GTEVKE9Q06AFVGQT5ZYC0GEM")}
+}
+
+func TestReplacedInstanceId(t *testing.T) {
+	client := NewOpampClient(Config{}, testSupervisor{}, testLogger{t})
+	for _, kv := range client.createAgentDescription().NonIdentifyingAttributes {
+		assert.NotEqual(t, "service.instance.replaced_id", kv.Key)
+	}
+
+	client = NewOpampClient(Config{}, clonedSupervisor{}, testLogger{t})
+	description := client.createAgentDescription()
+	assert.Equal(t, "01GTEVKE9Q06AFVGQT5ZYC0GEK", description.IdentifyingAttributes[2].Value.GetStringValue())
+	replaced := description.NonIdentifyingAttributes[len(description.NonIdentifyingAttributes)-1]
+	assert.Equal(t, "service.instance.replaced_id", replaced.Key)
+	assert.Equal(t, "01GTEVKE9Q06AFVGQT5ZYC0GEM", replaced.Value.GetStringValue())
+}
@@ -4,9 +4,11 @@ import "github.com/oklog/ulid/v2"
 
 type Agent struct {
 	InstanceId ulid.ULID
-	Host       Host
-	Os         Os
-	Service    Service
+	// Previous instance id of a cloned agent, zero otherwise.
+	ReplacedInstanceId ulid.ULID
+	Host               Host
+	Os                 Os
+	Service            Service
 }
 
 type Host struct {
@@ -33,3 +35,10 @@ type RemoteConfig struct {
 	Configs map[string]ConfigFile
 	Hash    string
 }
+
+// RemoteConfigStatus is the outcome of applying a remote config.
+type RemoteConfigStatus struct {
+	Hash         string
+	Applied      bool
+	ErrorMessage string
+}
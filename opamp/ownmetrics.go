@@ -0,0 +1,221 @@
+package opamp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"net/http"
+	"strconv"
+	"superagent/metrics"
+	"time"
+)
+
+// DefaultOwnMetricsInterval is how often the own metrics are exported once the server offered a destination.
+const DefaultOwnMetricsInterval = 30 * time.Second
+
+// ownMetricsExporter periodically sends the metrics of the supervisor to the OTLP/HTTP receiver the server
+// offered. The payload uses the JSON encoding of OTLP, which the receivers accept along with protobuf.
+type ownMetricsExporter struct {
+	client   *Client
+	endpoint string
+	header   http.Header
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// onOwnMetricsSettings replaces the exporter of the own metrics with one that sends them as settings says.
+// Nothing is exported once the client is stopped.
+func (c *Client) onOwnMetricsSettings(settings *protobufs.TelemetryConnectionSettings) {
+	c.ownMetricsMu.Lock()
+	if c.ownMetricsStopped {
+		c.ownMetricsMu.Unlock()
+		return
+	}
+	previous := c.ownMetrics
+	c.ownMetrics = nil
+	if settings.DestinationEndpoint == "" {
+		c.Logger.Debugf("Own metrics destination removed by the server.")
+	} else {
+		c.Logger.Debugf("Exporting own metrics to %s.", settings.DestinationEndpoint)
+		header := http.Header{}
+		for _, h := range settings.GetHeaders().GetHeaders() {
+			header.Set(h.Key, h.Value)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		c.ownMetrics = &ownMetricsExporter{
+			client:   c,
+			endpoint: settings.DestinationEndpoint,
+			header:   header,
+			cancel:   cancel,
+			done:     make(chan struct{}),
+		}
+		go c.ownMetrics.run(ctx)
+	}
+	c.ownMetricsMu.Unlock()
+	previous.stop()
+}
+
+// stopOwnMetrics stops exporting the own metrics for good.
+func (c *Client) stopOwnMetrics() {
+	c.ownMetricsMu.Lock()
+	c.ownMetricsStopped = true
+	exporter := c.ownMetrics
+	c.ownMetrics = nil
+	c.ownMetricsMu.Unlock()
+	exporter.stop()
+}
+
+// stop stops the exporter and waits until it is done. A nil exporter does nothing.
+func (e *ownMetricsExporter) stop() {
+	if e != nil {
+		e.cancel()
+		<-e.done
+	}
+}
+
+func (e *ownMetricsExporter) run(ctx context.Context) {
+	defer close(e.done)
+	interval := e.client.OwnMetricsInterval
+	if interval <= 0 {
+		interval = DefaultOwnMetricsInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := e.export(ctx); err != nil {
+			e.client.Logger.Errorf("Cannot export own metrics: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (e *ownMetricsExporter) export(ctx context.Context) error {
+	body, err := json.Marshal(e.client.ownMetricsPayload(time.Now()))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = e.header.Clone()
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("receiver %s answered %s", e.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// The subset of the OTLP metrics data model, in its JSON encoding, used for the own metrics.
+type otlpMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Unit        string     `json:"unit"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+}
+
+// Cumulative, as the counters are never reset.
+const otlpAggregationTemporalityCumulative = 2
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+// The 64 bits integers are strings in the JSON encoding of OTLP.
+type otlpDataPoint struct {
+	StartTimeUnixNano string   `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string   `json:"timeUnixNano"`
+	AsInt             string   `json:"asInt,omitempty"`
+	AsDouble          *float64 `json:"asDouble,omitempty"`
+}
+
+func (c *Client) ownMetricsPayload(now time.Time) otlpMetricsRequest {
+	var attributes []otlpKeyValue
+	for _, kv := range c.createAgentDescription().IdentifyingAttributes {
+		attributes = append(attributes, otlpKeyValue{Key: kv.Key, Value: otlpAnyValue{StringValue: kv.Value.GetStringValue()}})
+	}
+
+	startTime, timestamp := unixNano(c.startTime), unixNano(now)
+	sum := func(name string, description string, unit string, counter *metrics.Counter) otlpMetric {
+		return otlpMetric{Name: name, Description: description, Unit: unit, Sum: &otlpSum{
+			DataPoints:             []otlpDataPoint{{StartTimeUnixNano: startTime, TimeUnixNano: timestamp, AsInt: strconv.FormatInt(counter.Value(), 10)}},
+			AggregationTemporality: otlpAggregationTemporalityCumulative,
+			IsMonotonic:            true,
+		}}
+	}
+	var uptime float64
+	if agentStart := c.agentStartTime(); !agentStart.IsZero() {
+		uptime = now.Sub(agentStart).Seconds()
+	}
+
+	m := c.Metrics
+	return otlpMetricsRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: attributes},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope: otlpScope{Name: "superagent"},
+			Metrics: []otlpMetric{
+				sum("superagent.agent.restarts", "Restarts of the agent process after it exited on its own.", "{restart}", &m.Restarts),
+				sum("superagent.agent.unexpected_exits", "Exits of the agent process that were not asked for.", "{exit}", &m.UnexpectedExits),
+				sum("superagent.remote_configs.applied", "Remote configs applied.", "{config}", &m.RemoteConfigsApplied),
+				sum("superagent.remote_configs.failed", "Remote configs that could not be applied.", "{config}", &m.RemoteConfigsFailed),
+				{Name: "superagent.agent.uptime", Description: "Time since the agent process was started, zero if it is not running.", Unit: "s",
+					Gauge: &otlpGauge{DataPoints: []otlpDataPoint{{TimeUnixNano: timestamp, AsDouble: &uptime}}}},
+			},
+		}},
+	}}}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
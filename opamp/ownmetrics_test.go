@@ -0,0 +1,114 @@
+package opamp
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"superagent/metrics"
+	"testing"
+	"time"
+)
+
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Debugf(format string, v ...interface{}) {
+	l.t.Logf(format, v...)
+}
+
+func (l testLogger) Errorf(format string, v ...interface{}) {
+	l.t.Logf(format, v...)
+}
+
+type testSupervisor struct{}
+
+func (testSupervisor) GetAgentDescription() Agent {
+	return Agent{Service: Service{Name: "io.opentelemetry.collector", Version: "0.0.1"}}
+}
+
+func (testSupervisor) GetEffectiveConfigMap() map[string]ConfigFile {
+	return nil
+}
+
+func (testSupervisor) ApplyRemoteConfig(context.Context, RemoteConfig) {}
+
+type otlpRequest struct {
+	header  http.Header
+	payload otlpMetricsRequest
+}
+
+func TestOwnMetrics(t *testing.T) {
+	requests := make(chan otlpRequest, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/metrics", r.URL.Path)
+		var payload otlpMetricsRequest
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&payload))
+		requests <- otlpRequest{header: r.Header, payload: payload}
+	}))
+	defer receiver.Close()
+
+	client := NewOpampClient(Config{}, testSupervisor{}, testLogger{t})
+	client.Metrics = metrics.NewAgent()
+	client.Metrics.Restarts.Inc()
+	client.Metrics.RemoteConfigsApplied.Inc()
+	client.Metrics.RemoteConfigsFailed.Inc()
+	client.Metrics.RemoteConfigsFailed.Inc()
+	client.OwnMetricsInterval = 10 * time.Millisecond
+	client.agentStart.Store(time.Now().Add(-time.Minute))
+
+	client.onMessage(context.Background(), &types.MessageData{OwnMetricsConnSettings: &protobufs.TelemetryConnectionSettings{
+		DestinationEndpoint: receiver.URL + "/v1/metrics",
+		Headers:             &protobufs.Headers{Headers: []*protobufs.Header{{Key: "Api-Key", Value: "metrics-key"}}},
+	}})
+	defer client.stopOwnMetrics()
+
+	var request otlpRequest
+	select {
+	case request = <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no metrics exported")
+	}
+	assert.Equal(t, "metrics-key", request.header.Get("Api-Key"))
+	assert.Equal(t, "application/json", request.header.Get("Content-Type"))
+
+	resource := request.payload.ResourceMetrics[0]
+	assert.Contains(t, resource.Resource.Attributes, otlpKeyValue{Key: "service.name", Value: otlpAnyValue{StringValue: "io.opentelemetry.collector"}})
+	values := make(map[string]otlpDataPoint)
+	for _, metric := range resource.ScopeMetrics[0].Metrics {
+		if metric.Sum != nil {
+			values[metric.Name] = metric.Sum.DataPoints[0]
+		} else {
+			values[metric.Name] = metric.Gauge.DataPoints[0]
+		}
+	}
+	assert.Equal(t, "1", values["superagent.agent.restarts"].AsInt)
+	assert.Equal(t, "1", values["superagent.remote_configs.applied"].AsInt)
+	assert.Equal(t, "2", values["superagent.remote_configs.failed"].AsInt)
+	assert.GreaterOrEqual(t, *values["superagent.agent.uptime"].AsDouble, 60.0)
+
+	// The metrics keep being exported until the server takes the destination back.
+	<-requests
+	client.onMessage(context.Background(), &types.MessageData{OwnMetricsConnSettings: &protobufs.TelemetryConnectionSettings{}})
+	for len(requests) > 0 {
+		<-requests
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, requests)
+}
+
+func TestOwnMetricsAfterStop(t *testing.T) {
+	client := NewOpampClient(Config{}, testSupervisor{}, testLogger{t})
+	client.Metrics = metrics.NewAgent()
+	client.stopOwnMetrics()
+
+	// Settings received while the client stops are ignored, so nothing is left exporting.
+	client.onOwnMetricsSettings(&protobufs.TelemetryConnectionSettings{DestinationEndpoint: "http://localhost:1/v1/metrics"})
+	client.ownMetricsMu.Lock()
+	defer client.ownMetricsMu.Unlock()
+	assert.Nil(t, client.ownMetrics)
+}
@@ -5,9 +5,11 @@ import (
 	"errors"
 	"fmt"
 	"github.com/open-telemetry/opamp-go/client/types"
-	"log"
+	"io"
 	"os"
 	"os/exec"
+	"superagent/metrics"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -17,55 +19,83 @@ import (
 // for the Agent process to finish.
 type Commander struct {
 	logger     types.Logger
+	logWriter  io.Writer
+	env        []string
+	dir        string
 	executable string
 	args       []string
+	mu         sync.Mutex
 	cmd        *exec.Cmd
+	pid        int
+	exitCode   int
 	doneCh     chan struct{}
 	waitCh     chan struct{}
 	running    int64
+	// The process being stopped by Stop, its exit is expected.
+	stopping *exec.Cmd
+	metrics  *metrics.Agent
 }
 
-func NewCommander(logger types.Logger, executable string, args ...string) (*Commander, error) {
+// NewCommander creates a Commander. The agent process inherits the environment of the meta agent
+// plus env, and runs in dir, or in the working directory of the meta agent if dir is empty.
+func NewCommander(logger types.Logger, logWriter io.Writer, env []string, dir string, executable string, args ...string) (*Commander, error) {
 	if executable == "" {
 		return nil, errors.New("executable must not be empty")
 	}
 
 	return &Commander{
 		logger:     logger,
+		logWriter:  logWriter,
+		env:        env,
+		dir:        dir,
 		executable: executable,
 		args:       args,
 	}, nil
 }
 
+// SetMetrics makes the Commander count the unexpected exits of the Agent process in m.
+func (c *Commander) SetMetrics(m *metrics.Agent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics = m
+}
+
 // Start the Agent and begin watching the process.
-// Agent's stdout and stderr are written to a file.
+// Agent's stdout and stderr are written to the log writer.
 func (c *Commander) Start(ctx context.Context) error {
-	log.Default().Print()
 	c.logger.Debugf(fmt.Sprintf("Starting agent %s", c.executable))
 
-	logFilePath := "agent.log"
-	logFile, err := os.Create(logFilePath)
-	if err != nil {
-		return fmt.Errorf("cannot create %s: %s", logFilePath, err.Error())
+	cmd := exec.CommandContext(ctx, c.executable, c.args...)
+	if len(c.env) > 0 {
+		// Later values take precedence, so the agent's variables override the inherited ones.
+		cmd.Env = append(os.Environ(), c.env...)
 	}
+	cmd.Dir = c.dir
 
-	c.cmd = exec.CommandContext(ctx, c.executable, c.args...)
-
-	// Capture standard output and standard error.
-	c.cmd.Stdout = logFile
-	c.cmd.Stderr = logFile
-
-	c.doneCh = make(chan struct{}, 1)
-	c.waitCh = make(chan struct{})
+	// Capture standard output and standard error. The writer is not an *os.File, so the
+	// output goes through a pipe and the log file can be rotated while the process runs.
+	cmd.Stdout = c.logWriter
+	cmd.Stderr = c.logWriter
+	// Children of the agent may keep the pipe open after it exits, don't wait for them forever.
+	cmd.WaitDelay = time.Second
 
-	if err := c.cmd.Start(); err != nil {
+	if err := cmd.Start(); err != nil {
 		return err
 	}
 
-	c.logger.Debugf(fmt.Sprintf("Agent process started, PID=%d", c.cmd.Process.Pid))
+	doneCh := make(chan struct{}, 1)
+	waitCh := make(chan struct{})
+	c.mu.Lock()
+	c.cmd = cmd
+	c.pid = cmd.Process.Pid
+	c.doneCh = doneCh
+	c.waitCh = waitCh
+	c.mu.Unlock()
+
+	c.logger.Debugf(fmt.Sprintf("Agent process started, PID=%d", cmd.Process.Pid))
 	atomic.StoreInt64(&c.running, 1)
 
-	go c.watch()
+	go c.watch(cmd, doneCh, waitCh)
 
 	return nil
 }
@@ -80,32 +110,40 @@ func (c *Commander) Restart(ctx context.Context) error {
 	return nil
 }
 
-func (c *Commander) watch() {
-	c.cmd.Wait()
-	c.doneCh <- struct{}{}
-	atomic.StoreInt64(&c.running, 0)
-	close(c.waitCh)
+func (c *Commander) watch(cmd *exec.Cmd, doneCh chan struct{}, waitCh chan struct{}) {
+	cmd.Wait()
+	c.mu.Lock()
+	if c.cmd == cmd {
+		c.exitCode = cmd.ProcessState.ExitCode()
+		atomic.StoreInt64(&c.running, 0)
+	}
+	if c.stopping != cmd && c.metrics != nil {
+		c.metrics.UnexpectedExits.Inc()
+	}
+	c.mu.Unlock()
+	doneCh <- struct{}{}
+	close(waitCh)
 }
 
 // Done returns a channel that will send a signal when the Agent process is finished.
 func (c *Commander) Done() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.doneCh
 }
 
 // Pid returns Agent process PID if it is started or 0 if it is not.
 func (c *Commander) Pid() int {
-	if c.cmd == nil || c.cmd.Process == nil {
-		return 0
-	}
-	return c.cmd.Process.Pid
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pid
 }
 
-// ExitCode returns Agent process exit code if it exited or 0 if it is not.
+// ExitCode returns the exit code of the last Agent process that exited, or 0 if none did.
 func (c *Commander) ExitCode() int {
-	if c.cmd == nil || c.cmd.ProcessState == nil {
-		return 0
-	}
-	return c.cmd.ProcessState.ExitCode()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.exitCode
 }
 
 func (c *Commander) IsRunning() bool {
@@ -114,55 +152,71 @@ func (c *Commander) IsRunning() bool {
 
 // Stop the Agent process. Sends SIGTERM to the process and wait for up 10 seconds
 // and if the process does not finish kills it forcedly by sending SIGKILL.
+// The process is also killed if ctx is done before, in which case the error wraps ctx.Err().
 // Returns after the process is terminated.
 func (c *Commander) Stop(ctx context.Context) error {
-	if c.cmd == nil || c.cmd.Process == nil {
+	c.mu.Lock()
+	cmd, waitCh := c.cmd, c.waitCh
+	// An exit that watch already saw was unexpected, this only concerns the exits to come.
+	c.stopping = cmd
+	c.mu.Unlock()
+	if cmd == nil || cmd.Process == nil {
 		// Not started, nothing to do.
 		return nil
 	}
+	pid := cmd.Process.Pid
 
-	c.logger.Debugf(fmt.Sprintf("Stopping agent process, PID=%v", c.cmd.Process.Pid))
+	c.logger.Debugf(fmt.Sprintf("Stopping agent process, PID=%v", pid))
 
 	// Gracefully signal process to stop.
-	if err := c.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		if errors.Is(err, os.ErrProcessDone) {
+			// Already exited on its own.
+			<-waitCh
+			return nil
+		}
 		return err
 	}
 
 	finished := make(chan struct{})
+	killErr := make(chan error, 1)
 
 	// Setup a goroutine to wait a while for process to finish and send kill signal
 	// to the process if it doesn't finish.
-	var innerErr error
 	go func() {
 		// Wait 10 seconds.
 		t := time.After(10 * time.Second)
+		var cause error
 		select {
 		case <-ctx.Done():
-			break
+			cause = ctx.Err()
 		case <-t:
 			break
 		case <-finished:
 			// Process is successfully finished.
-			c.logger.Debugf(fmt.Sprintf("Agent process PID=%v successfully stopped.", c.cmd.Process.Pid))
+			c.logger.Debugf(fmt.Sprintf("Agent process PID=%v successfully stopped.", pid))
+			killErr <- nil
 			return
 		}
 
 		// Time is out. Kill the process.
 		c.logger.Debugf(
 			fmt.Sprintf("Agent process PID=%d is not responding to SIGTERM. Sending SIGKILL to kill forcedly.",
-				c.cmd.Process.Pid))
-		if innerErr = c.cmd.Process.Signal(syscall.SIGKILL); innerErr != nil {
-			return
+				pid))
+		err := cmd.Process.Signal(syscall.SIGKILL)
+		if cause != nil {
+			err = fmt.Errorf("agent process PID=%d killed: %w", pid, errors.Join(cause, err))
 		}
+		killErr <- err
 	}()
 
 	// Wait for process to terminate
-	<-c.waitCh
+	<-waitCh
 
 	atomic.StoreInt64(&c.running, 0)
 
 	// Let goroutine know process is finished.
 	close(finished)
 
-	return innerErr
+	return <-killErr
 }
@@ -1,22 +1,44 @@
 package otelcol
 
 import (
+	"github.com/oklog/ulid/v2"
 	"superagent/supervisor"
 )
 
+const (
+	nrdotServiceName = "com.newrelic.nrdot"
+	// Environment variable the nrdot collector reads its New Relic license key from.
+	nrdotLicenseKeyEnv = "NEW_RELIC_LICENSE_KEY"
+)
+
 type Nrdot struct {
-	DataDir string
-	LogDir  string
-	BinPath string
-	Name    string
+	DataDir       string
+	LogDir        string
+	LogRotation   supervisor.LogRotation
+	RestartPolicy supervisor.RestartPolicy
+	BinPath       string
+	Name          string
+	OpampUrl      string
+	ApiKey        string
+	// Extra headers of the OpAMP requests.
+	Headers map[string]string
+	// Extra arguments of the agent process, after the config paths.
+	Args []string
+	// Environment variables of the agent process, as KEY=value.
+	Env        []string
+	WorkingDir string
+	// Instance id the agent is pinned to, zero to use the one kept in DataDir.
+	InstanceId ulid.ULID
 }
 
+// NrDotSupervisor runs nrdot with the same lifecycle as an OpenTelemetry collector,
+// with New Relic specific defaults.
 type NrDotSupervisor struct {
-	Config Nrdot
+	*Supervisor
 }
 
-func NewNrDot(name string, dataDir string, logDir string, binPath string) *Nrdot {
-	return &Nrdot{Name: name, DataDir: dataDir, LogDir: logDir, BinPath: binPath}
+func NewNrDot(name string, dataDir string, logDir string, logRotation supervisor.LogRotation, restartPolicy supervisor.RestartPolicy, binPath string, opampUrl string, apiKey string) *Nrdot {
+	return &Nrdot{Name: name, DataDir: dataDir, LogDir: logDir, LogRotation: logRotation, RestartPolicy: restartPolicy, BinPath: binPath, OpampUrl: opampUrl, ApiKey: apiKey}
 }
 
 func (nrdot *Nrdot) GetType() string {
@@ -27,26 +49,26 @@ func (nrdot *Nrdot) GetName() string {
 	return nrdot.Name
 }
 
-func (nrdot *Nrdot) GetSupervisor() supervisor.Supervisor {
-	return &NrDotSupervisor{Config: *nrdot}
-}
-
-func (supervisor *NrDotSupervisor) Start() error {
-	return nil
+func (nrdot *Nrdot) GetExecutable() string {
+	return nrdot.BinPath
 }
 
-func (supervisor *NrDotSupervisor) Stop() error {
-	return nil
-}
-
-func (sup *NrDotSupervisor) Setup() error {
-	err := supervisor.EnsureDirExists(sup.Config.DataDir)
-	if err != nil {
-		return err
-	}
-	err = supervisor.EnsureDirExists(sup.Config.LogDir)
-	if err != nil {
-		return err
+func (nrdot *Nrdot) GetSupervisor() supervisor.Supervisor {
+	config := OtelCol{
+		DataDir:       nrdot.DataDir,
+		LogDir:        nrdot.LogDir,
+		LogRotation:   nrdot.LogRotation,
+		RestartPolicy: nrdot.RestartPolicy,
+		BinPath:       nrdot.BinPath,
+		Name:          nrdot.Name,
+		OpampUrl:      nrdot.OpampUrl,
+		ApiKey:        nrdot.ApiKey,
+		Headers:       nrdot.Headers,
+		Args:          nrdot.Args,
+		Env:           nrdot.Env,
+		WorkingDir:    nrdot.WorkingDir,
+		InstanceId:    nrdot.InstanceId,
 	}
-	return nil
+	env := []string{nrdotLicenseKeyEnv + "=" + nrdot.ApiKey}
+	return &NrDotSupervisor{Supervisor: newSupervisor(config, nrdotServiceName, env)}
 }
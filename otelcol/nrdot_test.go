@@ -0,0 +1,31 @@
+package otelcol
+
+import (
+	"github.com/stretchr/testify/assert"
+	"superagent/supervisor"
+	"testing"
+)
+
+func TestNrDotSupervisorDefaults(t *testing.T) {
+	nrdot := NewNrDot("nrdot-name", "/tmp/data", "/tmp/log", supervisor.DefaultLogRotation(), supervisor.DefaultRestartPolicy(), "/usr/bin/nrdot", "url", "key")
+	sup := nrdot.GetSupervisor().(*NrDotSupervisor)
+
+	assert.Equal(t, []string{"NEW_RELIC_LICENSE_KEY=key"}, sup.Env)
+	assert.Equal(t, "com.newrelic.nrdot", sup.GetAgentDescription().Service.Name)
+	assert.Equal(t, "url", sup.Config.OpampUrl)
+}
+
+func TestNrDotSupervisorOverrides(t *testing.T) {
+	nrdot := NewNrDot("nrdot-name", "/tmp/data", "/tmp/log", supervisor.DefaultLogRotation(), supervisor.DefaultRestartPolicy(), "/usr/bin/nrdot", "url", "team-key")
+	nrdot.Env = []string{"GOMAXPROCS=2"}
+	nrdot.Args = []string{"--feature-gates", "+exporter.foo"}
+	nrdot.Headers = map[string]string{"X-Team": "team-a"}
+	nrdot.WorkingDir = "/opt/team-a"
+	sup := nrdot.GetSupervisor().(*NrDotSupervisor)
+
+	assert.Equal(t, []string{"NEW_RELIC_LICENSE_KEY=team-key"}, sup.Env)
+	assert.Equal(t, []string{"GOMAXPROCS=2"}, sup.Config.Env)
+	assert.Equal(t, []string{"--feature-gates", "+exporter.foo"}, sup.Config.Args)
+	assert.Equal(t, map[string]string{"X-Team": "team-a"}, sup.Config.Headers)
+	assert.Equal(t, "/opt/team-a", sup.Config.WorkingDir)
+}
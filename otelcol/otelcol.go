@@ -2,47 +2,96 @@ package otelcol
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/knadh/koanf"
 	"github.com/knadh/koanf/parsers/yaml"
 	"github.com/knadh/koanf/providers/rawbytes"
 	"github.com/oklog/ulid/v2"
-	"github.com/open-telemetry/opamp-go/client/types"
-	"log"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"superagent/events"
+	"superagent/metrics"
 	"superagent/opamp"
 	"superagent/supervisor"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type OtelCol struct {
-	DataDir  string
-	LogDir   string
-	BinPath  string
-	Name     string
-	OpampUrl string
-	ApiKey   string
+	DataDir       string
+	LogDir        string
+	LogRotation   supervisor.LogRotation
+	RestartPolicy supervisor.RestartPolicy
+	BinPath       string
+	Name          string
+	OpampUrl      string
+	ApiKey        string
+	// Extra headers of the OpAMP requests.
+	Headers map[string]string
+	// Extra arguments of the agent process, after the config paths.
+	Args []string
+	// Environment variables of the agent process, as KEY=value.
+	Env        []string
+	WorkingDir string
+	// Instance id the agent is pinned to, zero to use the one kept in DataDir.
+	InstanceId ulid.ULID
 }
 
 type Supervisor struct {
-	Config      OtelCol
+	Config OtelCol
+	// Service name reported to the OpAMP server.
+	ServiceName string
+	// Environment variables the agent type sets for its process, as KEY=value.
+	// The variables of the config take precedence.
+	Env         []string
 	Commander   *Commander
 	OpampClient *opamp.Client
-	Logger      types.Logger
-	InstanceId  ulid.ULID
+	// Creates the client of OpampClient, the default one if nil.
+	NewOpampClient opamp.ClientFactory
+	Logger         *supervisor.Logger
+	Clock          supervisor.Clock
+	Metrics        *metrics.Agent
+	// Where the lifecycle events of the agent are published, nowhere if nil.
+	Events     *events.Bus
+	InstanceId ulid.ULID
+	// Instance id that InstanceId replaced because DataDir was cloned from another host, zero otherwise.
+	ReplacedInstanceId ulid.ULID
+	LogFile            *supervisor.LogFile
 	// Final effective config of the Collector.
 	EffectiveConfig atomic.Value
+	// Hash of the last remote config applied.
+	configHash atomic.Value
+	// Guards appliedConfig and pendingConfig, which the OpAMP callbacks and the loop of the runner share,
+	// and orders what is saved and reported about the remote configs.
+	remoteConfigMu sync.Mutex
+	// Last remote config applied, nil if none.
+	appliedConfig *opamp.RemoteConfig
+	// Remote config the agent is to be restarted with, signaled by hasNewConfig, nil if none.
+	pendingConfig *pendingRemoteConfig
+	// Whether the agent is being restarted with a remote config.
+	applying bool
 
 	// A channel to indicate there is a new config to apply.
 	hasNewConfig chan struct{}
+	// Runs the agent process once started, nil before.
+	runner   *Runner
+	stopOnce sync.Once
 }
 
-func NewOtelCol(name string, dataDir string, logDir string, binPath string, opampUrl string, apiKey string) *OtelCol {
-	return &OtelCol{Name: name, DataDir: dataDir, LogDir: logDir, BinPath: binPath, OpampUrl: opampUrl, ApiKey: apiKey}
+// pendingRemoteConfig is a remote config received that the agent is not restarted with yet.
+type pendingRemoteConfig struct {
+	config     opamp.RemoteConfig
+	receivedAt time.Time
+	// Effective config of the last config applied, which is restored if this one cannot be applied.
+	previous string
+}
+
+func NewOtelCol(name string, dataDir string, logDir string, logRotation supervisor.LogRotation, restartPolicy supervisor.RestartPolicy, binPath string, opampUrl string, apiKey string) *OtelCol {
+	return &OtelCol{Name: name, DataDir: dataDir, LogDir: logDir, LogRotation: logRotation, RestartPolicy: restartPolicy, BinPath: binPath, OpampUrl: opampUrl, ApiKey: apiKey}
 }
 
 func (otelcol *OtelCol) GetType() string {
@@ -53,39 +102,138 @@ func (otelcol *OtelCol) GetName() string {
 	return otelcol.Name
 }
 
+func (otelcol *OtelCol) GetExecutable() string {
+	return otelcol.BinPath
+}
+
 func (otelcol *OtelCol) GetSupervisor() supervisor.Supervisor {
-	logger := &supervisor.Logger{Logger: log.Default()}
-	return &Supervisor{Config: *otelcol, Logger: logger, hasNewConfig: make(chan struct{}, 1)}
+	return newSupervisor(*otelcol, "io.opentelemetry.collector", nil)
+}
+
+func newSupervisor(config OtelCol, serviceName string, env []string) *Supervisor {
+	return &Supervisor{
+		Config:       config,
+		ServiceName:  serviceName,
+		Env:          env,
+		Logger:       supervisor.DefaultLogger(),
+		Clock:        supervisor.RealClock{},
+		Metrics:      metrics.NewAgent(),
+		hasNewConfig: make(chan struct{}, 1),
+	}
+}
+
+func (s *Supervisor) Configure(options supervisor.Options) {
+	if options.Logger != nil {
+		s.Logger = options.Logger
+	}
+	if options.Clock != nil {
+		s.Clock = options.Clock
+	}
+	if options.Metrics != nil {
+		s.Metrics = options.Metrics
+	}
+	s.Events = options.Events
+	s.NewOpampClient = options.NewOpampClient
+}
+
+func (s *Supervisor) Health() supervisor.Health {
+	if s.runner == nil {
+		return supervisor.Health{State: supervisor.StateStopped}
+	}
+	return s.runner.Health()
+}
+
+func (s *Supervisor) Status() supervisor.Status {
+	status := supervisor.Status{Health: s.Health()}
+	if s.runner != nil {
+		status = s.runner.Status()
+	}
+	if s.OpampClient != nil {
+		status.OpampConnection = supervisor.Disconnected
+		if s.OpampClient.Connected() {
+			status.OpampConnection = supervisor.Connected
+		}
+	}
+	status.ConfigHash, _ = s.configHash.Load().(string)
+	return status
+}
+
+// reportHealth reports the health of the agent to the OpAMP server.
+func (s *Supervisor) reportHealth(health supervisor.Health) {
+	if health.State == supervisor.StateWaitingForConfig {
+		// Nothing runs yet, there is no health to report.
+		return
+	}
+	if health.Healthy {
+		s.OpampClient.SetHealthy(health.StartTime)
+		return
+	}
+	s.OpampClient.SetUnhealthy(health.LastError)
 }
 
 func (s *Supervisor) Start() error {
-	var err error
-	s.InstanceId, err = supervisor.GetOrCreateInstanceId(s.Config.DataDir)
+	identity, err := supervisor.GetOrCreateInstanceId(s.Config.DataDir, supervisor.HostFingerprint(), s.Config.InstanceId)
 	if err != nil {
 		return err
 	}
+	s.InstanceId, s.ReplacedInstanceId = identity.Id, identity.Replaced
+	s.Logger = s.Logger.With("instance.id", s.InstanceId.String())
+	if s.ReplacedInstanceId != (ulid.ULID{}) {
+		s.Logger.Warnf("The data directory %s was created on another host, instance id %s replaced by %s.",
+			s.Config.DataDir, s.ReplacedInstanceId, s.InstanceId)
+	}
 
-	commander, err := NewCommander(s.Logger, s.Config.BinPath, s.getConfigPaths()...)
+	s.LogFile = supervisor.NewLogFile(s.Config.LogDir, s.Config.Name, s.Config.LogRotation)
+	env := append(append([]string{}, s.Env...), s.Config.Env...)
+	args := append(s.getConfigPaths(), s.Config.Args...)
+	commander, err := NewCommander(s.Logger, s.LogFile, env, s.Config.WorkingDir, s.Config.BinPath, args...)
 	if err != nil {
 		return err
 	}
+	commander.SetMetrics(s.Metrics)
 	s.Commander = commander
+	s.runner = NewRunner(s.Config.Name, commander, s.Config.RestartPolicy, supervisor.Options{
+		Logger: s.Logger, Clock: s.Clock, Metrics: s.Metrics, Events: s.Events,
+	})
+	s.runner.OnHealth = s.reportHealth
+	s.runner.CheckRestart = s.checkRestart
+	s.runner.NewConfig, s.runner.ApplyConfig = s.hasNewConfig, s.applyConfigWithAgentRestart
 
 	opampClient := opamp.NewOpampClient(
 		opamp.Config{
 			OpampUrl: s.Config.OpampUrl,
 			ApiKey:   s.Config.ApiKey,
+			Headers:  s.Config.Headers,
 		},
 		s,
 		s.Logger)
 
+	opampClient.NewClient = s.NewOpampClient
+	opampClient.Metrics = s.Metrics
+	opampClient.OnConnectionChange = s.onOpampConnectionChange
+	opampClient.RemoteConfigStatus = s.restoreRemoteConfig()
 	s.OpampClient = &opampClient
 	err = s.OpampClient.StartOpAMP()
 	if err != nil {
 		return fmt.Errorf("cannot start the opamp client %s", err)
 	}
 
-	go s.runAgentProcess()
+	// The agent is started before Start returns, so its state tells at once whether it is coming up.
+	if err := s.checkEffectiveConfigFile(); err == nil {
+		// We have an effective config file saved previously. Use it to start the agent.
+		if err := s.runner.StartProcess(); err != nil {
+			// Nothing is left behind, the supervisor is not started.
+			s.runner = nil
+			return errors.Join(err, s.OpampClient.StopOpAMP(context.Background()), s.LogFile.Close())
+		}
+	} else {
+		if !errors.Is(err, os.ErrNotExist) {
+			s.Logger.Errorf("Cannot use the effective config file saved previously, waiting for a new config: %v", err)
+		}
+		// No process runs, so the agent is neither healthy nor ready until its config comes.
+		s.runner.setHealth(supervisor.Health{State: supervisor.StateWaitingForConfig})
+	}
+	s.runner.Run()
 	return nil
 }
 
@@ -94,85 +242,136 @@ func (s *Supervisor) getEffectiveConfigFilePath() string {
 	return filepath.Join(s.Config.DataDir, "effective.yaml")
 }
 
-func (s *Supervisor) runAgentProcess() {
-	if _, err := os.Stat(s.getEffectiveConfigFilePath()); err == nil {
-		// We have an effective config file saved previously. Use it to start the agent.
-		s.startAgent()
+func (s *Supervisor) applyConfigWithAgentRestart() {
+	s.remoteConfigMu.Lock()
+	pending := s.pendingConfig
+	s.pendingConfig = nil
+	s.applying = pending != nil
+	cfg, _ := s.EffectiveConfig.Load().(string)
+	s.remoteConfigMu.Unlock()
+	if pending == nil {
+		// Applied already along with a config received before it was signaled.
+		return
 	}
 
-	restartTimer := time.NewTimer(0)
-	restartTimer.Stop()
-
-	for {
-		select {
-		case <-s.hasNewConfig:
-			restartTimer.Stop()
-			s.applyConfigWithAgentRestart()
+	s.Logger.Debugf("Restarting the agent with the new config.")
+	if err := s.writeEffectiveConfigToFile(cfg); err != nil {
+		s.Logger.Errorf("Cannot write the effective config file, the agent keeps running with its config: %v", err)
+		s.configFailed(pending, fmt.Errorf("cannot write the effective config file: %w", err))
+		return
+	}
+	err := s.Commander.Stop(context.Background())
+	if err != nil {
+		s.Logger.Errorf("cannot stop agent %v", err)
+	}
+	if err := s.runner.StartProcess(); err != nil {
+		s.configFailed(pending, fmt.Errorf("cannot start the agent with the config: %w", err))
+		return
+	}
 
-		case <-s.Commander.Done():
-			errMsg := fmt.Sprintf(
-				"Agent process PID=%d exited unexpectedly, exit code=%d. Will restart in a bit...",
-				s.Commander.Pid(), s.Commander.ExitCode(),
-			)
-			s.Logger.Debugf(errMsg)
-			s.OpampClient.SetUnhealthy(errMsg)
+	s.remoteConfigMu.Lock()
+	defer s.remoteConfigMu.Unlock()
+	s.applying = false
+	s.configApplied(pending.config)
+	s.OpampClient.SetRemoteConfig(context.Background())
+	s.countConfigApplied(pending.receivedAt)
+}
 
-			// Wait 5 seconds before starting again.
-			restartTimer.Stop()
-			restartTimer.Reset(5 * time.Second)
+// configApplied reports and saves that the agent runs with config. remoteConfigMu must be held.
+func (s *Supervisor) configApplied(config opamp.RemoteConfig) {
+	hash := fmt.Sprintf("%x", config.Hash)
+	s.OpampClient.SetRemoteConfigApplied(config.Hash)
+	s.configHash.Store(hash)
+	s.saveRemoteConfig(config, opamp.RemoteConfigStatus{Hash: config.Hash, Applied: true})
+	s.runner.Publish(events.RemoteConfigApplied, map[string]string{"hash": hash})
+}
 
-		case <-restartTimer.C:
-			s.startAgent()
+// configFailed reports and saves that the agent could not be restarted with the pending config. The effective
+// config and its file go back to the ones of the last config applied, so the same config received again is
+// tried again, and the agent is not started with a config the server was told failed.
+func (s *Supervisor) configFailed(pending *pendingRemoteConfig, err error) {
+	s.remoteConfigMu.Lock()
+	defer s.remoteConfigMu.Unlock()
+	s.applying = false
+	if s.pendingConfig == nil {
+		s.EffectiveConfig.Store(pending.previous)
+		var restoreErr error
+		if pending.previous == "" {
+			restoreErr = os.Remove(s.getEffectiveConfigFilePath())
+		} else {
+			restoreErr = s.writeEffectiveConfigToFile(pending.previous)
 		}
+		if restoreErr != nil && !errors.Is(restoreErr, os.ErrNotExist) {
+			s.Logger.Errorf("Cannot restore the effective config file: %v", restoreErr)
+		}
+	} else {
+		// A newer config replaces this one, it is restored if the newer one fails too.
+		s.pendingConfig.previous = pending.previous
 	}
+	hash := fmt.Sprintf("%x", pending.config.Hash)
+	s.Metrics.RemoteConfigsFailed.Inc()
+	s.runner.Publish(events.RemoteConfigRejected, map[string]string{"hash": hash, "error": err.Error()})
+	s.saveRemoteConfig(pending.config, opamp.RemoteConfigStatus{Hash: pending.config.Hash, ErrorMessage: err.Error()})
+	s.OpampClient.SetRemoteConfigError(pending.config.Hash, err.Error())
 }
 
-func (s *Supervisor) applyConfigWithAgentRestart() {
-	s.Logger.Debugf("Restarting the agent with the new config.")
-	cfg := s.EffectiveConfig.Load().(string)
-	err := s.Commander.Stop(context.Background())
-	if err != nil {
-		s.Logger.Errorf("cannot stop agent %v", err)
-	}
-	s.writeEffectiveConfigToFile(cfg)
-	s.startAgent()
+// countConfigApplied counts a remote config received at receivedAt once the agent runs with it.
+func (s *Supervisor) countConfigApplied(receivedAt time.Time) {
+	s.Metrics.RemoteConfigsApplied.Inc()
+	s.Metrics.ConfigApplyLatency.Observe(s.Clock.Now().Sub(receivedAt))
 }
 
-func (s *Supervisor) startAgent() {
-	err := s.Commander.Start(context.Background())
-	if err != nil {
-		errMsg := fmt.Sprintf("Cannot start the agent: %v", err)
-		s.Logger.Errorf(errMsg)
-		s.OpampClient.SetUnhealthy(errMsg)
-		return
+// Restart stops the agent process and starts it again with the same config. The agent gets a fresh set
+// of restart attempts, even if it was crash-looping.
+func (s *Supervisor) Restart(ctx context.Context) error {
+	if s.runner == nil {
+		return fmt.Errorf("cannot restart agent %s: %w", s.Config.Name, ErrNotStarted)
 	}
-	s.OpampClient.SetHealthy(time.Now())
+	return s.runner.Restart(ctx)
 }
 
-func (s *Supervisor) writeEffectiveConfigToFile(cfg string) {
-	f, err := os.Create(s.getEffectiveConfigFilePath())
-	if err != nil {
-		s.Logger.Errorf("Cannot write effective config file: %v", err)
+func (s *Supervisor) checkRestart() error {
+	if err := s.checkEffectiveConfigFile(); err != nil {
+		return fmt.Errorf("cannot restart the agent without a valid config: %w", err)
 	}
-	defer func() {
-		err = f.Close()
-		if err != nil {
-			s.Logger.Errorf("Error closing file %v", err)
-		}
-	}()
+	return nil
+}
 
-	_, err = f.WriteString(cfg)
-	if err != nil {
-		s.Logger.Errorf("Error writing effective config %v", err)
+func (s *Supervisor) onOpampConnectionChange(connected bool, err error) {
+	if connected {
+		s.runner.Publish(events.OpampConnected, nil)
+		return
 	}
+	s.runner.Publish(events.OpampDisconnected, map[string]string{"error": err.Error()})
+}
+
+func (s *Supervisor) writeEffectiveConfigToFile(cfg string) error {
+	return supervisor.WriteFile(s.getEffectiveConfigFilePath(), []byte(cfg), supervisor.PrivateFilePerm)
+}
+
+// checkEffectiveConfigFile tells why the effective config file saved previously cannot be used, if it cannot.
+func (s *Supervisor) checkEffectiveConfigFile() error {
+	_, err := supervisor.ReadFile(s.getEffectiveConfigFilePath())
+	return err
 }
 
 func (s *Supervisor) getConfigPaths() []string {
 	return []string{filepath.Join(s.Config.DataDir, "configuration", "otelcol.yaml")}
 }
 
-func (s *Supervisor) Stop() error {
-	return s.Commander.Stop(context.Background())
+// Stop stops the agent for good. Stopping a supervisor that is stopped already does nothing.
+func (s *Supervisor) Stop(ctx context.Context) error {
+	var err error
+	s.stopOnce.Do(func() {
+		if s.runner == nil {
+			return
+		}
+		err = s.runner.Stop(ctx)
+		// Stop reporting for an agent that is gone, it could be removed from the config.
+		// This is done even if the agent could not be stopped cleanly, so nothing is left behind.
+		err = errors.Join(err, s.OpampClient.StopOpAMP(ctx), s.LogFile.Close())
+	})
+	return err
 }
 
 func (s *Supervisor) Setup() error {
@@ -202,39 +401,63 @@ func (s *Supervisor) GetAgentDescription() opamp.Agent {
 	}
 
 	service := opamp.Service{
-		Name:    "io.opentelemetry.collector",
+		Name:    s.ServiceName,
 		Version: "0.0.1",
 	}
 	return opamp.Agent{
-		InstanceId: s.InstanceId,
-		Host:       host,
-		Os:         operatingSystem,
-		Service:    service,
+		InstanceId:         s.InstanceId,
+		ReplacedInstanceId: s.ReplacedInstanceId,
+		Host:               host,
+		Os:                 operatingSystem,
+		Service:            service,
 	}
 }
 
+// GetEffectiveConfig returns the config the agent runs with, empty if it got none yet.
+func (s *Supervisor) GetEffectiveConfig() string {
+	config, _ := s.EffectiveConfig.Load().(string)
+	return config
+}
+
 func (s *Supervisor) GetEffectiveConfigMap() map[string]opamp.ConfigFile {
 	return make(map[string]opamp.ConfigFile)
 }
 
 func (s *Supervisor) ApplyRemoteConfig(ctx context.Context, config opamp.RemoteConfig) {
+	receivedAt := s.Clock.Now()
+	s.Metrics.RemoteConfigsReceived.Inc()
+	hash := fmt.Sprintf("%x", config.Hash)
+	s.runner.Publish(events.RemoteConfigReceived, map[string]string{"hash": hash})
+
+	s.remoteConfigMu.Lock()
+	defer s.remoteConfigMu.Unlock()
+	previous, _ := s.EffectiveConfig.Load().(string)
+	if s.pendingConfig != nil {
+		previous = s.pendingConfig.previous
+	}
 	configChanged, err := s.composeEffectiveConfig(config)
 	if err != nil {
+		s.Metrics.RemoteConfigsFailed.Inc()
+		s.runner.Publish(events.RemoteConfigRejected, map[string]string{"hash": hash, "error": err.Error()})
+		s.saveRemoteConfig(config, opamp.RemoteConfigStatus{Hash: config.Hash, ErrorMessage: err.Error()})
 		s.OpampClient.SetRemoteConfigError(config.Hash, err.Error())
-	} else {
-		s.OpampClient.SetRemoteConfigApplied(config.Hash)
+		return
 	}
-
-	if configChanged {
-		s.OpampClient.SetRemoteConfig(ctx)
-		s.Logger.Debugf("Config is changed. Signal to restart the agent.")
-		// Signal that there is a new config.
-		select {
-		case s.hasNewConfig <- struct{}{}:
-		default:
-		}
+	if !configChanged && s.pendingConfig == nil && !s.applying {
+		// Nothing to restart, the agent runs with the config already.
+		s.configApplied(config)
+		s.countConfigApplied(receivedAt)
+		return
 	}
 
+	// The config is reported, saved and counted as applied, with its latency, once the agent is restarted with it.
+	s.pendingConfig = &pendingRemoteConfig{config: config, receivedAt: receivedAt, previous: previous}
+	s.Logger.Debugf("Config is changed. Signal to restart the agent.")
+	// Signal that there is a new config.
+	select {
+	case s.hasNewConfig <- struct{}{}:
+	default:
+	}
 }
 
 func (s *Supervisor) composeEffectiveConfig(config opamp.RemoteConfig) (configChanged bool, err error) {
@@ -0,0 +1,64 @@
+package otelcol
+
+import (
+	"context"
+	"github.com/open-telemetry/opamp-go/client"
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"superagent/supervisor"
+	"testing"
+	"time"
+)
+
+func TestConfigApplyMetrics(t *testing.T) {
+	sup, _ := startTestSupervisor(t, t.TempDir(), "/bin/true")
+	defer sup.Stop(context.Background())
+
+	// A config is applied once the agent runs with it.
+	sup.ApplyRemoteConfig(context.Background(), remoteConfig("h1", "receivers:\n  otlp: {}\n"))
+	assert.Eventually(t, func() bool {
+		return sup.Metrics.RemoteConfigsApplied.Value() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint64(1), sup.Metrics.ConfigApplyLatency.Snapshot().Count)
+
+	// The same config again changes nothing, the agent runs with it already.
+	sup.ApplyRemoteConfig(context.Background(), remoteConfig("h1", "receivers:\n  otlp: {}\n"))
+	assert.Equal(t, int64(2), sup.Metrics.RemoteConfigsApplied.Value())
+	assert.Equal(t, uint64(2), sup.Metrics.ConfigApplyLatency.Snapshot().Count)
+	assert.Equal(t, int64(0), sup.Metrics.RemoteConfigsFailed.Value())
+}
+
+func TestConfigApplyMetricsAgentNotStarted(t *testing.T) {
+	sup, _ := startTestSupervisor(t, t.TempDir(), "/nonexistent/otelcol")
+	defer sup.Stop(context.Background())
+
+	sup.ApplyRemoteConfig(context.Background(), remoteConfig("h1", "receivers:\n  otlp: {}\n"))
+	assert.Eventually(t, func() bool {
+		return sup.Metrics.RemoteConfigsFailed.Value() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(0), sup.Metrics.RemoteConfigsApplied.Value())
+	assert.Equal(t, uint64(0), sup.Metrics.ConfigApplyLatency.Snapshot().Count)
+}
+
+func TestStartWithSavedConfigFails(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "data"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "data", "effective.yaml"), []byte("receivers: {}\n"), 0600))
+	otelcol := NewOtelCol("collector", filepath.Join(dir, "data"), filepath.Join(dir, "log"), supervisor.DefaultLogRotation(), supervisor.DefaultRestartPolicy(), "/nonexistent/otelcol", "url", "key")
+	sup := otelcol.GetSupervisor().(*Supervisor)
+	fake := &fakeOpampClient{}
+	sup.Configure(supervisor.Options{NewOpampClient: func(logger types.Logger) client.OpAMPClient {
+		return fake
+	}})
+	assert.Nil(t, sup.Setup())
+
+	// The agent cannot run with the config saved previously, so the supervisor is not started.
+	err := sup.Start()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "/nonexistent/otelcol")
+	assert.True(t, fake.stopped)
+	assert.ErrorIs(t, sup.Restart(context.Background()), ErrNotStarted)
+	assert.Nil(t, sup.Stop(context.Background()))
+}
@@ -0,0 +1,98 @@
+package otelcol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"superagent/opamp"
+	"superagent/supervisor"
+)
+
+// savedRemoteConfig is what is kept in the data directory about the remote configs: the last one applied,
+// which the agent runs with, and the outcome of the last one received, which is the applied one unless it
+// was rejected. The hashes are raw bytes, so they are not JSON strings.
+type savedRemoteConfig struct {
+	Applied *savedConfig `json:"applied,omitempty"`
+	Status  savedStatus  `json:"status"`
+}
+
+type savedConfig struct {
+	Hash    []byte                     `json:"hash"`
+	Configs map[string]savedConfigFile `json:"configs"`
+}
+
+type savedConfigFile struct {
+	Content     string `json:"content"`
+	ContentType string `json:"contentType"`
+}
+
+type savedStatus struct {
+	Hash         []byte `json:"hash"`
+	Applied      bool   `json:"applied"`
+	ErrorMessage string `json:"errorMessage,omitempty"`
+}
+
+func (s *Supervisor) getRemoteConfigFilePath() string {
+	return filepath.Join(s.Config.DataDir, "remote_config.json")
+}
+
+// saveRemoteConfig keeps the outcome of the last remote config received, along with the last one applied,
+// so they are known after a restart. config is the one received, it is kept as applied if it is.
+func (s *Supervisor) saveRemoteConfig(config opamp.RemoteConfig, status opamp.RemoteConfigStatus) {
+	if status.Applied {
+		s.appliedConfig = &config
+	}
+	saved := savedRemoteConfig{
+		Status: savedStatus{Hash: []byte(status.Hash), Applied: status.Applied, ErrorMessage: status.ErrorMessage},
+	}
+	if s.appliedConfig != nil {
+		saved.Applied = &savedConfig{Hash: []byte(s.appliedConfig.Hash), Configs: make(map[string]savedConfigFile)}
+		for name, file := range s.appliedConfig.Configs {
+			saved.Applied.Configs[name] = savedConfigFile{Content: file.Content, ContentType: file.ContentType}
+		}
+	}
+	content, err := json.Marshal(saved)
+	if err == nil {
+		err = supervisor.WriteFile(s.getRemoteConfigFilePath(), content, supervisor.PrivateFilePerm)
+	}
+	if err != nil {
+		s.Logger.Errorf("Cannot save the remote config: %v", err)
+	}
+}
+
+// restoreRemoteConfig reads back the remote configs kept before a restart. The effective config and the hash
+// of the last config applied are restored, so the same config received again does not restart the agent.
+// It returns the status of the last config received, to report to the server, nil if none was received yet.
+func (s *Supervisor) restoreRemoteConfig() *opamp.RemoteConfigStatus {
+	content, err := supervisor.ReadFile(s.getRemoteConfigFilePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	var saved savedRemoteConfig
+	if err == nil {
+		err = json.Unmarshal(content, &saved)
+	}
+	if err != nil {
+		s.Logger.Errorf("Cannot restore the remote config, waiting for the server to send it again: %v", err)
+		return nil
+	}
+
+	if saved.Applied != nil {
+		config := opamp.RemoteConfig{Hash: string(saved.Applied.Hash), Configs: make(map[string]opamp.ConfigFile)}
+		for name, file := range saved.Applied.Configs {
+			config.Configs[name] = opamp.ConfigFile{Content: file.Content, ContentType: file.ContentType}
+		}
+		if _, err := s.composeEffectiveConfig(config); err != nil {
+			s.Logger.Errorf("Cannot restore the effective config: %v", err)
+		}
+		s.appliedConfig = &config
+		s.configHash.Store(fmt.Sprintf("%x", config.Hash))
+	}
+	return &opamp.RemoteConfigStatus{
+		Hash:         string(saved.Status.Hash),
+		Applied:      saved.Status.Applied,
+		ErrorMessage: saved.Status.ErrorMessage,
+	}
+}
@@ -0,0 +1,147 @@
+package otelcol
+
+import (
+	"context"
+	"errors"
+	"github.com/open-telemetry/opamp-go/client"
+	"github.com/open-telemetry/opamp-go/client/types"
+	"github.com/open-telemetry/opamp-go/protobufs"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"superagent/opamp"
+	"superagent/supervisor"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeOpampClient records the status and the effective configs reported instead of connecting to a server.
+type fakeOpampClient struct {
+	client.OpAMPClient
+	mu               sync.Mutex
+	startStatus      *protobufs.RemoteConfigStatus
+	effectiveUpdates int
+	stopped          bool
+}
+
+func (c *fakeOpampClient) Start(ctx context.Context, settings types.StartSettings) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.startStatus = settings.RemoteConfigStatus
+	return nil
+}
+
+func (c *fakeOpampClient) Stop(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+	return nil
+}
+
+func (c *fakeOpampClient) SetAgentDescription(descr *protobufs.AgentDescription) error {
+	return nil
+}
+
+func (c *fakeOpampClient) SetHealth(health *protobufs.AgentHealth) error {
+	return nil
+}
+
+func (c *fakeOpampClient) SetRemoteConfigStatus(status *protobufs.RemoteConfigStatus) error {
+	return nil
+}
+
+func (c *fakeOpampClient) UpdateEffectiveConfig(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.effectiveUpdates++
+	return nil
+}
+
+func startTestSupervisor(t *testing.T, dir string, executable string) (*Supervisor, *fakeOpampClient) {
+	policy := supervisor.DefaultRestartPolicy()
+	policy.Mode = supervisor.RestartNever
+	otelcol := NewOtelCol("collector", filepath.Join(dir, "data"), filepath.Join(dir, "log"), supervisor.DefaultLogRotation(), policy, executable, "url", "key")
+	sup := otelcol.GetSupervisor().(*Supervisor)
+	fake := &fakeOpampClient{}
+	sup.Configure(supervisor.Options{NewOpampClient: func(logger types.Logger) client.OpAMPClient {
+		return fake
+	}})
+	assert.Nil(t, sup.Setup())
+	assert.Nil(t, sup.Start())
+	return sup, fake
+}
+
+func remoteConfig(hash string, content string) opamp.RemoteConfig {
+	return opamp.RemoteConfig{Hash: hash, Configs: map[string]opamp.ConfigFile{
+		"collector": {Content: content, ContentType: "text/yaml"},
+	}}
+}
+
+func TestRemoteConfigRestored(t *testing.T) {
+	dir := t.TempDir()
+	sup, fake := startTestSupervisor(t, dir, "/bin/true")
+	assert.Nil(t, fake.startStatus)
+	sup.ApplyRemoteConfig(context.Background(), remoteConfig("h1", "receivers:\n  otlp: {}\n"))
+	// The agent is restarted with the config in the background.
+	assert.Eventually(t, func() bool {
+		return sup.Metrics.RemoteConfigsApplied.Value() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, fake.effectiveUpdates)
+	assert.Nil(t, sup.Stop(context.Background()))
+
+	// The server sees at once that the config is applied, and sending it again changes nothing.
+	sup, fake = startTestSupervisor(t, dir, "/bin/true")
+	assert.Equal(t, &protobufs.RemoteConfigStatus{
+		LastRemoteConfigHash: []byte("h1"),
+		Status:               protobufs.RemoteConfigStatuses_RemoteConfigStatuses_APPLIED,
+	}, fake.startStatus)
+	assert.Equal(t, "6831", sup.Status().ConfigHash)
+	effectiveConfig := sup.GetEffectiveConfig()
+	sup.ApplyRemoteConfig(context.Background(), remoteConfig("h1", "receivers:\n  otlp: {}\n"))
+	assert.Equal(t, 0, fake.effectiveUpdates)
+
+	sup.ApplyRemoteConfig(context.Background(), remoteConfig("h2", "receivers: [\n"))
+	assert.Nil(t, sup.Stop(context.Background()))
+	assert.Nil(t, sup.Stop(context.Background()))
+
+	// A config that failed is reported as such, the agent keeps the last config applied and its hash.
+	sup, fake = startTestSupervisor(t, dir, "/bin/true")
+	defer sup.Stop(context.Background())
+	assert.Equal(t, []byte("h2"), fake.startStatus.LastRemoteConfigHash)
+	assert.Equal(t, protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED, fake.startStatus.Status)
+	assert.Contains(t, fake.startStatus.ErrorMessage, "cannot parse config named collector")
+	assert.Equal(t, effectiveConfig, sup.GetEffectiveConfig())
+	assert.Equal(t, "6831", sup.Status().ConfigHash)
+
+	// The last config applied is still the one sent again after another restart.
+	sup.ApplyRemoteConfig(context.Background(), remoteConfig("h1", "receivers:\n  otlp: {}\n"))
+	assert.Equal(t, 0, fake.effectiveUpdates)
+}
+
+func TestRemoteConfigAgentNotStarted(t *testing.T) {
+	dir := t.TempDir()
+	sup, _ := startTestSupervisor(t, dir, "/nonexistent/otelcol")
+	sup.ApplyRemoteConfig(context.Background(), remoteConfig("h1", "receivers:\n  otlp: {}\n"))
+	assert.Eventually(t, func() bool {
+		return sup.Metrics.RemoteConfigsFailed.Value() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Nil(t, sup.Stop(context.Background()))
+
+	// The config is not applied since the agent did not start with it, so it is not kept.
+	sup, fake := startTestSupervisor(t, dir, "/bin/true")
+	defer sup.Stop(context.Background())
+	assert.Equal(t, []byte("h1"), fake.startStatus.LastRemoteConfigHash)
+	assert.Equal(t, protobufs.RemoteConfigStatuses_RemoteConfigStatuses_FAILED, fake.startStatus.Status)
+	assert.Contains(t, fake.startStatus.ErrorMessage, "cannot start the agent with the config")
+	assert.Equal(t, "", sup.GetEffectiveConfig())
+	assert.Equal(t, "", sup.Status().ConfigHash)
+	_, err := os.Stat(sup.getEffectiveConfigFilePath())
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	// The same config received again is tried again.
+	sup.ApplyRemoteConfig(context.Background(), remoteConfig("h1", "receivers:\n  otlp: {}\n"))
+	assert.Eventually(t, func() bool {
+		return sup.Metrics.RemoteConfigsApplied.Value() == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
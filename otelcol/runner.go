@@ -0,0 +1,253 @@
+package otelcol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"superagent/events"
+	"superagent/metrics"
+	"superagent/supervisor"
+	"sync"
+	"time"
+)
+
+// ErrNotStarted is returned when an agent is restarted before its supervisor is started.
+var ErrNotStarted = errors.New("supervisor is not started")
+
+// Runner runs the process of a Commander and restarts it according to a restart policy, when it exits
+// on its own or when asked to. It is shared by the supervisors of every agent type, which add what is
+// specific to them through the hooks.
+type Runner struct {
+	// Name of the agent, for the events and the log messages.
+	Name      string
+	Commander *Commander
+	Policy    supervisor.RestartPolicy
+	Logger    *supervisor.Logger
+	Clock     supervisor.Clock
+	Metrics   *metrics.Agent
+	// Where the lifecycle events of the agent are published, nowhere if nil.
+	Events *events.Bus
+
+	// Called when the health of the agent changes, except when it is stopped. May be nil.
+	OnHealth func(health supervisor.Health)
+	// Tells why the agent cannot be restarted on request, nil if it can. May be nil.
+	CheckRestart func() error
+	// Signals a new config, which ApplyConfig is called for from the loop. The agent gets a fresh set
+	// of restart attempts. May be nil.
+	NewConfig   <-chan struct{}
+	ApplyConfig func()
+
+	// Closed when the runner is stopped, so the agent is not restarted.
+	stopCh chan struct{}
+	// Closed when the loop returned, nil if it was not run.
+	doneCh chan struct{}
+	// Restart requests, served by the loop.
+	restartCh chan restartRequest
+	restarts  *supervisor.RestartTracker
+	healthMu  sync.Mutex
+	health    supervisor.Health
+}
+
+type restartRequest struct {
+	ctx  context.Context
+	done chan error
+}
+
+// NewRunner creates the runner of the process of commander, taking the logger, clock, metrics and events
+// from options.
+func NewRunner(name string, commander *Commander, policy supervisor.RestartPolicy, options supervisor.Options) *Runner {
+	return &Runner{
+		Name:      name,
+		Commander: commander,
+		Policy:    policy,
+		Logger:    options.Logger,
+		Clock:     options.Clock,
+		Metrics:   options.Metrics,
+		Events:    options.Events,
+		stopCh:    make(chan struct{}),
+		restartCh: make(chan restartRequest),
+		restarts:  supervisor.NewRestartTracker(policy),
+		health:    supervisor.Health{State: supervisor.StateStopped},
+	}
+}
+
+func (r *Runner) Health() supervisor.Health {
+	r.healthMu.Lock()
+	defer r.healthMu.Unlock()
+	return r.health
+}
+
+// Status returns the health of the agent along with its process and restarts.
+func (r *Runner) Status() supervisor.Status {
+	return supervisor.Status{
+		Health:       r.Health(),
+		Pid:          r.Commander.Pid(),
+		LastExitCode: r.Commander.ExitCode(),
+		Restarts:     r.restarts.Restarts(),
+	}
+}
+
+func (r *Runner) setHealth(health supervisor.Health) {
+	r.healthMu.Lock()
+	r.health = health
+	r.healthMu.Unlock()
+	if r.OnHealth != nil {
+		r.OnHealth(health)
+	}
+}
+
+// Publish publishes an event about the agent.
+func (r *Runner) Publish(eventType events.Type, details map[string]string) {
+	r.Events.Publish(events.Event{Type: eventType, Agent: r.Name, Time: r.Clock.Now(), Details: details})
+}
+
+// StartProcess starts the agent process. It must be called before Run, or from the loop once Run is called.
+func (r *Runner) StartProcess() error {
+	err := r.Commander.Start(context.Background())
+	if err != nil {
+		errMsg := fmt.Sprintf("Cannot start agent %s: %v", r.Name, err)
+		r.Logger.Errorf(errMsg)
+		r.setHealth(supervisor.Health{State: supervisor.StateStopped, LastError: errMsg})
+		return err
+	}
+	r.setHealth(supervisor.Health{Healthy: true, State: supervisor.StateRunning, StartTime: r.Clock.Now()})
+	r.Publish(events.AgentStarted, map[string]string{"pid": strconv.Itoa(r.Commander.Pid())})
+	return nil
+}
+
+// Run watches the agent process and serves the restart requests in the background, until the runner is stopped.
+func (r *Runner) Run() {
+	r.doneCh = make(chan struct{})
+	go func() {
+		defer close(r.doneCh)
+		r.run()
+	}()
+}
+
+func (r *Runner) run() {
+	// Fires when the agent is to be restarted after an exit, nil when no restart is scheduled.
+	var backoff <-chan time.Time
+
+	for {
+		select {
+		case <-r.stopCh:
+			return
+
+		case <-r.NewConfig:
+			backoff = nil
+			// A new config deserves a fresh set of attempts, even when crash-looping.
+			r.restarts.Reset()
+			r.ApplyConfig()
+
+		case <-r.Commander.Done():
+			select {
+			case <-r.stopCh:
+				// The agent was stopped on purpose.
+				return
+			default:
+			}
+			backoff = r.handleExit()
+
+		case <-backoff:
+			backoff = nil
+			r.Metrics.Restarts.Inc()
+			if err := r.StartProcess(); err != nil {
+				// A restart that fails counts as an exit, or the agent would stay stopped.
+				backoff = r.scheduleRestart(fmt.Sprintf("Agent %s could not be restarted: %v.", r.Name, err))
+			}
+
+		case request := <-r.restartCh:
+			backoff = nil
+			request.done <- r.restart(request.ctx)
+		}
+	}
+}
+
+// handleExit decides, according to the restart policy, whether and when to restart
+// an agent process that exited on its own. It returns what fires when the agent is to be restarted,
+// nil if it is not.
+func (r *Runner) handleExit() <-chan time.Time {
+	pid, exitCode := r.Commander.Pid(), r.Commander.ExitCode()
+	r.Publish(events.AgentExited, map[string]string{"pid": strconv.Itoa(pid), "exitCode": strconv.Itoa(exitCode)})
+
+	if !r.restarts.ShouldRestart(exitCode) {
+		errMsg := fmt.Sprintf(
+			"Agent %s PID=%d exited, exit code=%d. Not restarting it, restart mode is %s.",
+			r.Name, pid, exitCode, r.Policy.Mode,
+		)
+		r.Logger.Debugf(errMsg)
+		r.setHealth(supervisor.Health{State: supervisor.StateStopped, LastError: errMsg})
+		return nil
+	}
+
+	return r.scheduleRestart(fmt.Sprintf("Agent %s PID=%d exited unexpectedly, exit code=%d.", r.Name, pid, exitCode))
+}
+
+// scheduleRestart schedules the restart of the agent after a failure, described by reason, unless it
+// is crash-looping. It returns what fires when the agent is to be restarted, nil if it is not.
+func (r *Runner) scheduleRestart(reason string) <-chan time.Time {
+	now := r.Clock.Now()
+	delay, ok := r.restarts.Next(now)
+	if !ok {
+		errMsg := fmt.Sprintf(
+			"%s Agent is crash-looping: %d restarts in the last %s, %d restarts in total. Giving up.",
+			reason, r.restarts.RecentRestarts(now), r.Policy.Window, r.restarts.Restarts(),
+		)
+		r.Logger.Errorf(errMsg)
+		r.setHealth(supervisor.Health{State: supervisor.StateCrashLooping, LastError: errMsg})
+		r.Publish(events.CrashLoopDetected, map[string]string{"restarts": strconv.Itoa(r.restarts.Restarts())})
+		return nil
+	}
+
+	errMsg := fmt.Sprintf(
+		"%s Will restart in %s (%d restarts in total)...",
+		reason, delay.Round(time.Millisecond), r.restarts.Restarts(),
+	)
+	r.Logger.Debugf(errMsg)
+	r.setHealth(supervisor.Health{State: supervisor.StateBackoff, LastError: errMsg})
+	r.Publish(events.RestartScheduled, map[string]string{"delay": delay.String()})
+	return r.Clock.After(delay)
+}
+
+// Restart stops the agent process and starts it again. The agent gets a fresh set of restart attempts,
+// even if it was crash-looping.
+func (r *Runner) Restart(ctx context.Context) error {
+	request := restartRequest{ctx: ctx, done: make(chan error, 1)}
+	select {
+	case r.restartCh <- request:
+	case <-r.stopCh:
+		return fmt.Errorf("cannot restart agent %s, its supervisor is stopped", r.Name)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return <-request.done
+}
+
+func (r *Runner) restart(ctx context.Context) error {
+	if r.CheckRestart != nil {
+		if err := r.CheckRestart(); err != nil {
+			return err
+		}
+	}
+	r.Logger.Debugf("Restarting agent %s on request.", r.Name)
+	r.restarts.Reset()
+	if err := r.Commander.Stop(ctx); err != nil {
+		return err
+	}
+	return r.StartProcess()
+}
+
+// Stop stops the agent process for good. It must be called once.
+func (r *Runner) Stop(ctx context.Context) error {
+	close(r.stopCh)
+	if r.doneCh != nil {
+		// A restart or a config being applied could start the agent again, let it finish first.
+		<-r.doneCh
+	}
+	err := r.Commander.Stop(ctx)
+	r.healthMu.Lock()
+	r.health = supervisor.Health{State: supervisor.StateStopped}
+	r.healthMu.Unlock()
+	return err
+}
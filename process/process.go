@@ -0,0 +1,138 @@
+package process
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"superagent/events"
+	"superagent/metrics"
+	"superagent/otelcol"
+	"superagent/supervisor"
+	"sync"
+)
+
+// Process is an arbitrary executable babysat by the meta agent, without an OpAMP connection.
+type Process struct {
+	Name          string
+	DataDir       string
+	LogDir        string
+	LogRotation   supervisor.LogRotation
+	RestartPolicy supervisor.RestartPolicy
+	Executable    string
+	Args          []string
+	// Environment variables of the process, as KEY=value.
+	Env        []string
+	WorkingDir string
+}
+
+type Supervisor struct {
+	Config    Process
+	Commander *otelcol.Commander
+	Logger    *supervisor.Logger
+	Clock     supervisor.Clock
+	Metrics   *metrics.Agent
+	// Where the lifecycle events of the process are published, nowhere if nil.
+	Events  *events.Bus
+	LogFile *supervisor.LogFile
+
+	// Runs the process once started, nil before.
+	runner   *otelcol.Runner
+	stopOnce sync.Once
+}
+
+func (p *Process) GetType() string {
+	return "process"
+}
+
+func (p *Process) GetName() string {
+	return p.Name
+}
+
+func (p *Process) GetExecutable() string {
+	return p.Executable
+}
+
+func (p *Process) GetSupervisor() supervisor.Supervisor {
+	return &Supervisor{
+		Config:  *p,
+		Logger:  supervisor.DefaultLogger(),
+		Clock:   supervisor.RealClock{},
+		Metrics: metrics.NewAgent(),
+	}
+}
+
+func (s *Supervisor) Configure(options supervisor.Options) {
+	if options.Logger != nil {
+		s.Logger = options.Logger
+	}
+	if options.Clock != nil {
+		s.Clock = options.Clock
+	}
+	if options.Metrics != nil {
+		s.Metrics = options.Metrics
+	}
+	s.Events = options.Events
+}
+
+func (s *Supervisor) Setup() error {
+	err := supervisor.EnsureDirExists(s.Config.DataDir)
+	if err != nil {
+		return err
+	}
+	return supervisor.EnsureDirExists(s.Config.LogDir)
+}
+
+func (s *Supervisor) Start() error {
+	s.LogFile = supervisor.NewLogFile(s.Config.LogDir, s.Config.Name, s.Config.LogRotation)
+	commander, err := otelcol.NewCommander(s.Logger, s.LogFile, s.Config.Env, s.Config.WorkingDir, s.Config.Executable, s.Config.Args...)
+	if err != nil {
+		return err
+	}
+	commander.SetMetrics(s.Metrics)
+	s.Commander = commander
+	runner := otelcol.NewRunner(s.Config.Name, commander, s.Config.RestartPolicy, supervisor.Options{
+		Logger: s.Logger, Clock: s.Clock, Metrics: s.Metrics, Events: s.Events,
+	})
+
+	if err := runner.StartProcess(); err != nil {
+		return err
+	}
+	s.runner = runner
+	runner.Run()
+	return nil
+}
+
+// Stop stops the process for good. Stopping a supervisor that is stopped already does nothing.
+func (s *Supervisor) Stop(ctx context.Context) error {
+	var err error
+	s.stopOnce.Do(func() {
+		if s.runner == nil {
+			return
+		}
+		err = errors.Join(s.runner.Stop(ctx), s.LogFile.Close())
+	})
+	return err
+}
+
+// Restart stops the process and starts it again. The process gets a fresh set of restart attempts,
+// even if it was crash-looping.
+func (s *Supervisor) Restart(ctx context.Context) error {
+	if s.runner == nil {
+		return fmt.Errorf("cannot restart process %s: %w", s.Config.Name, otelcol.ErrNotStarted)
+	}
+	return s.runner.Restart(ctx)
+}
+
+func (s *Supervisor) Health() supervisor.Health {
+	if s.runner == nil {
+		return supervisor.Health{State: supervisor.StateStopped}
+	}
+	return s.runner.Health()
+}
+
+func (s *Supervisor) Status() supervisor.Status {
+	if s.runner == nil {
+		return supervisor.Status{Health: s.Health()}
+	}
+	return s.runner.Status()
+}
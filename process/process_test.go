@@ -0,0 +1,156 @@
+package process
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"superagent/otelcol"
+	"superagent/supervisor"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newTestProcess(t *testing.T, policy supervisor.RestartPolicy, args ...string) *Process {
+	dir := t.TempDir()
+	return &Process{
+		Name:          "helper",
+		DataDir:       filepath.Join(dir, "data"),
+		LogDir:        filepath.Join(dir, "log"),
+		LogRotation:   supervisor.DefaultLogRotation(),
+		RestartPolicy: policy,
+		Executable:    "/bin/sh",
+		Args:          args,
+		Env:           []string{"HELPER_GREETING=hello"},
+		WorkingDir:    dir,
+	}
+}
+
+func TestProcessRunsAndLogs(t *testing.T) {
+	p := newTestProcess(t, supervisor.DefaultRestartPolicy(), "-c", "echo $HELPER_GREETING from $(pwd); sleep 10")
+	sup := p.GetSupervisor().(*Supervisor)
+	assert.Nil(t, sup.Setup())
+	assert.Nil(t, sup.Start())
+
+	assert.Eventually(t, func() bool {
+		content, _ := os.ReadFile(filepath.Join(p.LogDir, "helper.log"))
+		return string(content) == "hello from "+p.WorkingDir+"\n"
+	}, 5*time.Second, 10*time.Millisecond)
+	health := sup.Health()
+	assert.True(t, health.Healthy)
+	assert.Equal(t, supervisor.StateRunning, health.State)
+
+	assert.Nil(t, sup.Stop(context.Background()))
+	assert.Equal(t, supervisor.StateStopped, sup.Health().State)
+	// Stopping again does nothing.
+	assert.Nil(t, sup.Stop(context.Background()))
+}
+
+func TestProcessCrashLoop(t *testing.T) {
+	policy := supervisor.RestartPolicy{
+		Mode:           supervisor.RestartOnFailure,
+		InitialBackoff: time.Millisecond,
+		MaxRestarts:    2,
+		Window:         time.Minute,
+	}
+	p := newTestProcess(t, policy, "-c", "exit 3")
+	sup := p.GetSupervisor().(*Supervisor)
+	assert.Nil(t, sup.Setup())
+	assert.Nil(t, sup.Start())
+	defer sup.Stop(context.Background())
+
+	assert.Eventually(t, func() bool {
+		return sup.Health().State == supervisor.StateCrashLooping
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, sup.Health().Healthy)
+	assert.Contains(t, sup.Health().LastError, "exit code=3")
+}
+
+func TestProcessCrashLoopFailedRestart(t *testing.T) {
+	policy := supervisor.RestartPolicy{
+		Mode:           supervisor.RestartOnFailure,
+		InitialBackoff: time.Millisecond,
+		MaxRestarts:    2,
+		Window:         time.Minute,
+	}
+	p := newTestProcess(t, policy, "-c", "exec sleep 10")
+	p.WorkingDir = filepath.Join(t.TempDir(), "work")
+	assert.Nil(t, os.Mkdir(p.WorkingDir, 0755))
+	sup := p.GetSupervisor().(*Supervisor)
+	assert.Nil(t, sup.Setup())
+	assert.Nil(t, sup.Start())
+	defer sup.Stop(context.Background())
+
+	// The process can no longer be started once it exits.
+	assert.Nil(t, os.Remove(p.WorkingDir))
+	assert.Nil(t, syscall.Kill(sup.Status().Pid, syscall.SIGKILL))
+	assert.Eventually(t, func() bool {
+		return sup.Health().State == supervisor.StateCrashLooping
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, sup.Health().LastError, "could not be restarted")
+}
+
+func TestProcessRestart(t *testing.T) {
+	policy := supervisor.RestartPolicy{
+		Mode:           supervisor.RestartOnFailure,
+		InitialBackoff: time.Millisecond,
+		MaxRestarts:    1,
+		Window:         time.Minute,
+	}
+	marker := filepath.Join(t.TempDir(), "marker")
+	// Crashes the first times, then runs once the marker exists.
+	p := newTestProcess(t, policy, "-c", "test -e "+marker+" || exit 3; exec sleep 10")
+	sup := p.GetSupervisor().(*Supervisor)
+	assert.Nil(t, sup.Setup())
+	assert.Nil(t, sup.Start())
+	assert.Eventually(t, func() bool {
+		return sup.Health().State == supervisor.StateCrashLooping
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A restart is not refused because the process was given up on.
+	assert.Nil(t, os.WriteFile(marker, nil, 0644))
+	assert.Nil(t, sup.Restart(context.Background()))
+	status := sup.Status()
+	assert.Equal(t, supervisor.StateRunning, status.State)
+	assert.Equal(t, 3, status.LastExitCode)
+	pid := status.Pid
+
+	assert.Nil(t, sup.Restart(context.Background()))
+	assert.NotEqual(t, pid, sup.Status().Pid)
+	assert.Equal(t, supervisor.StateRunning, sup.Health().State)
+
+	assert.Nil(t, sup.Stop(context.Background()))
+	assert.NotNil(t, sup.Restart(context.Background()))
+}
+
+func TestProcessRestartNotStarted(t *testing.T) {
+	p := newTestProcess(t, supervisor.DefaultRestartPolicy(), "-c", "exec sleep 10")
+	sup := p.GetSupervisor().(*Supervisor)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// Refused at once, not when ctx expires.
+	assert.ErrorIs(t, sup.Restart(ctx), otelcol.ErrNotStarted)
+	assert.Nil(t, ctx.Err())
+	assert.Nil(t, sup.Stop(context.Background()))
+}
+
+func TestProcessStopDuringRestart(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		p := newTestProcess(t, supervisor.DefaultRestartPolicy(), "-c", "exec sleep 10")
+		sup := p.GetSupervisor().(*Supervisor)
+		assert.Nil(t, sup.Setup())
+		assert.Nil(t, sup.Start())
+
+		restarted := make(chan struct{})
+		go func() {
+			defer close(restarted)
+			sup.Restart(context.Background())
+		}()
+		assert.Nil(t, sup.Stop(context.Background()))
+		<-restarted
+		// Whichever came first, no process is left running.
+		assert.NotNil(t, syscall.Kill(sup.Status().Pid, 0))
+	}
+}
@@ -0,0 +1,108 @@
+package supervisor
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/oklog/ulid/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Files of the instance identity in the data directory of an agent. The id file only holds the id,
+// as it always did. The host file holds the fingerprint of the host the id was created on, it is missing
+// when the id was created by an older version.
+const (
+	instanceIdFile = "ulid"
+	hostFile       = "ulid.host"
+)
+
+var machineIdPaths = []string{"/etc/machine-id", "/var/lib/dbus/machine-id"}
+
+// HostFingerprint identifies the host from its machine id, so renaming the host keeps its instance ids.
+// Without a machine id, which is usual in containers, the hostname identifies the host instead. A container
+// recreated under another hostname is then seen as another host, unless its instance id is pinned.
+// The fingerprint is empty when neither is known, in which case clones cannot be detected.
+func HostFingerprint() string {
+	for _, path := range machineIdPaths {
+		content, err := os.ReadFile(path)
+		if machineId := strings.TrimSpace(string(content)); err == nil && machineId != "" {
+			return fmt.Sprintf("%x", sha256.Sum256([]byte("machine-id:"+machineId)))
+		}
+	}
+	if hostname, _ := os.Hostname(); hostname != "" {
+		return fmt.Sprintf("%x", sha256.Sum256([]byte("hostname:"+hostname)))
+	}
+	return ""
+}
+
+// InstanceId is the identity of an agent instance.
+type InstanceId struct {
+	Id ulid.ULID
+	// Id found in the data directory and replaced because it was created on another host, which means
+	// the data directory was cloned. Zero otherwise.
+	Replaced ulid.ULID
+}
+
+// NewUlid returns a ULID with cryptographically random entropy, so ids created at the same millisecond
+// on different hosts do not collide.
+func NewUlid() (ulid.ULID, error) {
+	return ulid.New(ulid.Timestamp(time.Now()), rand.Reader)
+}
+
+// GetOrCreateInstanceId returns the instance id kept in dir, creating it if there is none. An id created
+// on a host other than the one of fingerprint is replaced by a new one. If pinned is not zero, it is the id,
+// whatever dir holds.
+func GetOrCreateInstanceId(dir string, fingerprint string, pinned ulid.ULID) (InstanceId, error) {
+	if pinned != (ulid.ULID{}) {
+		return InstanceId{Id: pinned}, writeInstanceId(dir, pinned, fingerprint)
+	}
+
+	content, err := ReadFile(filepath.Join(dir, instanceIdFile))
+	if errors.Is(err, os.ErrNotExist) {
+		id, err := NewUlid()
+		if err != nil {
+			return InstanceId{}, err
+		}
+		return InstanceId{Id: id}, writeInstanceId(dir, id, fingerprint)
+	}
+	if err != nil {
+		return InstanceId{}, fmt.Errorf("cannot read the instance id: %w", err)
+	}
+	id, err := ulid.ParseStrict(strings.TrimSpace(string(content)))
+	if err != nil {
+		return InstanceId{}, fmt.Errorf("invalid instance id in %s: %w", filepath.Join(dir, instanceIdFile), err)
+	}
+
+	host, err := ReadFile(filepath.Join(dir, hostFile))
+	if errors.Is(err, os.ErrNotExist) {
+		// Created by an older version, it is trusted and bound to this host from now on.
+		return InstanceId{Id: id}, writeHost(dir, fingerprint)
+	}
+	if err != nil {
+		return InstanceId{}, fmt.Errorf("cannot read the host of the instance id: %w", err)
+	}
+	if recorded := strings.TrimSpace(string(host)); recorded == fingerprint || recorded == "" || fingerprint == "" {
+		return InstanceId{Id: id}, nil
+	}
+
+	newId, err := NewUlid()
+	if err != nil {
+		return InstanceId{}, err
+	}
+	return InstanceId{Id: newId, Replaced: id}, writeInstanceId(dir, newId, fingerprint)
+}
+
+func writeInstanceId(dir string, id ulid.ULID, fingerprint string) error {
+	if err := WriteFile(filepath.Join(dir, instanceIdFile), []byte(id.String()), PrivateFilePerm); err != nil {
+		return err
+	}
+	return writeHost(dir, fingerprint)
+}
+
+func writeHost(dir string, fingerprint string) error {
+	return WriteFile(filepath.Join(dir, hostFile), []byte(fingerprint), PrivateFilePerm)
+}
@@ -0,0 +1,35 @@
+package supervisor
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrDirLocked is returned by LockDir when another process holds the lock.
+var ErrDirLocked = errors.New("locked by another process")
+
+// DirLock is an advisory lock on a directory, released when the process exits.
+type DirLock struct {
+	f *os.File
+}
+
+// LockDir takes the lock of dir, so that two meta agents do not share a data directory.
+func LockDir(dir string) (*DirLock, error) {
+	f, err := os.OpenFile(filepath.Join(dir, "superagent.lock"), os.O_RDWR|os.O_CREATE, PrivateFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", dir, err)
+	}
+	return &DirLock{f: f}, nil
+}
+
+func (l *DirLock) Unlock() error {
+	// Closing the file releases the lock. The file is kept, removing it would race with another process
+	// locking it.
+	return l.f.Close()
+}
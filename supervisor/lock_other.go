@@ -0,0 +1,10 @@
+//go:build !unix
+
+package supervisor
+
+import "os"
+
+// lockFile does not lock on the platforms without flock.
+func lockFile(f *os.File) error {
+	return nil
+}
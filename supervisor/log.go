@@ -1,15 +1,74 @@
 package supervisor
 
-import "log"
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"os"
+)
 
+type LogEncoding string
+
+const (
+	LogEncodingConsole LogEncoding = "console"
+	LogEncodingJSON    LogEncoding = "json"
+)
+
+// LogConfig tells how the meta agent writes its own logs to the standard error.
+type LogConfig struct {
+	Level    zapcore.Level
+	Encoding LogEncoding
+}
+
+func DefaultLogConfig() LogConfig {
+	return LogConfig{Level: zapcore.InfoLevel, Encoding: LogEncodingConsole}
+}
+
+func ParseLogLevel(level string) (zapcore.Level, error) {
+	var l zapcore.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return l, fmt.Errorf("Unknown log level '%s'", level)
+	}
+	return l, nil
+}
+
+func ParseLogEncoding(encoding string) (LogEncoding, error) {
+	switch LogEncoding(encoding) {
+	case LogEncodingConsole, LogEncodingJSON:
+		return LogEncoding(encoding), nil
+	}
+	return "", fmt.Errorf("Unknown log encoding '%s'", encoding)
+}
+
+// NewZapLogger creates the logger configured by config.
+func NewZapLogger(config LogConfig) *zap.Logger {
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	var encoder zapcore.Encoder
+	if config.Encoding == LogEncodingJSON {
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	} else {
+		encoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	}
+	return zap.New(zapcore.NewCore(encoder, zapcore.Lock(os.Stderr), config.Level))
+}
+
+// Logger is a structured logger that is also a Logger of opamp-go, so the OpAMP clients log through it.
 type Logger struct {
-	Logger *log.Logger
+	*zap.SugaredLogger
+}
+
+func NewLogger(logger *zap.Logger) *Logger {
+	return &Logger{SugaredLogger: logger.Sugar()}
 }
 
-func (l *Logger) Debugf(format string, v ...interface{}) {
-	l.Logger.Printf(format, v...)
+// DefaultLogger logs at the info level to the standard error.
+func DefaultLogger() *Logger {
+	return NewLogger(NewZapLogger(DefaultLogConfig()))
 }
 
-func (l *Logger) Errorf(format string, v ...interface{}) {
-	l.Logger.Printf(format, v...)
+// With returns a logger that adds the key-value pairs to every entry, for example "agent.name", name.
+func (l *Logger) With(keysAndValues ...interface{}) *Logger {
+	return &Logger{SugaredLogger: l.SugaredLogger.With(keysAndValues...)}
 }
@@ -0,0 +1,88 @@
+package supervisor
+
+import (
+	"gopkg.in/natefinch/lumberjack.v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// LogRotation holds the rotation and retention settings of the agent log files.
+type LogRotation struct {
+	// Size in megabytes at which the log file is rotated.
+	MaxSize int
+	// Age at which the log file is rotated, regardless of its size. Zero disables it.
+	MaxAge time.Duration
+	// Number of rotated files to keep.
+	MaxBackups int
+	// Whether rotated files are compressed with gzip.
+	Compress bool
+}
+
+func DefaultLogRotation() LogRotation {
+	return LogRotation{
+		MaxSize:    100,
+		MaxAge:     24 * time.Hour,
+		MaxBackups: 5,
+		Compress:   true,
+	}
+}
+
+// LogFile is the destination of an agent's stdout and stderr.
+// It rotates itself on size and age, so the agent process never needs to be restarted for it.
+type LogFile struct {
+	mu       sync.Mutex
+	logger   *lumberjack.Logger
+	maxAge   time.Duration
+	openedAt time.Time
+}
+
+// NewLogFile appends to the log file left by a previous run, if any. Its age is counted from its last
+// modification, so restarting the meta agent does not extend the life of the file.
+func NewLogFile(dir string, name string, rotation LogRotation) *LogFile {
+	filename := filepath.Join(dir, name+".log")
+	openedAt := time.Now()
+	if info, err := os.Stat(filename); err == nil {
+		openedAt = info.ModTime()
+	}
+	return &LogFile{
+		logger: &lumberjack.Logger{
+			Filename:   filename,
+			MaxSize:    rotation.MaxSize,
+			MaxBackups: rotation.MaxBackups,
+			Compress:   rotation.Compress,
+		},
+		maxAge:   rotation.MaxAge,
+		openedAt: openedAt,
+	}
+}
+
+func (l *LogFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxAge > 0 && time.Since(l.openedAt) >= l.maxAge {
+		if err := l.logger.Rotate(); err != nil {
+			return 0, err
+		}
+		l.openedAt = time.Now()
+	}
+	return l.logger.Write(p)
+}
+
+func (l *LogFile) Rotate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.openedAt = time.Now()
+	return l.logger.Rotate()
+}
+
+func (l *LogFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.logger.Close()
+}
+
+func (l *LogFile) Filename() string {
+	return l.logger.Filename
+}
@@ -0,0 +1,58 @@
+package supervisor
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backups returns the number of rotated files of the agent log in dir.
+func backups(t *testing.T, dir string) int {
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	count := 0
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "agent-") {
+			count++
+		}
+	}
+	return count
+}
+
+func TestLogFileRotatesOnAge(t *testing.T) {
+	dir := t.TempDir()
+	logFile := NewLogFile(dir, "agent", LogRotation{MaxAge: 10 * time.Millisecond, MaxBackups: 2})
+	defer logFile.Close()
+
+	_, err := logFile.Write([]byte("first\n"))
+	assert.Nil(t, err)
+	time.Sleep(20 * time.Millisecond)
+	_, err = logFile.Write([]byte("second\n"))
+	assert.Nil(t, err)
+
+	content, err := os.ReadFile(filepath.Join(dir, "agent.log"))
+	assert.Nil(t, err)
+	assert.Equal(t, "second\n", string(content))
+	assert.Equal(t, 1, backups(t, dir))
+}
+
+func TestLogFileAgeSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "agent.log")
+	assert.Nil(t, os.WriteFile(path, []byte("previous run\n"), 0644))
+	old := time.Now().Add(-2 * time.Hour)
+	assert.Nil(t, os.Chtimes(path, old, old))
+
+	logFile := NewLogFile(dir, "agent", LogRotation{MaxAge: time.Hour, MaxBackups: 2})
+	defer logFile.Close()
+	_, err := logFile.Write([]byte("this run\n"))
+	assert.Nil(t, err)
+
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "this run\n", string(content))
+	assert.Equal(t, 1, backups(t, dir))
+}
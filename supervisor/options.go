@@ -0,0 +1,43 @@
+package supervisor
+
+import (
+	"superagent/events"
+	"superagent/metrics"
+	"superagent/opamp"
+	"time"
+)
+
+// Clock tells the time. It can be replaced in tests.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// RealClock is the Clock of the system.
+type RealClock struct{}
+
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+func (RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Options are the services the meta agent provides to the supervisors. The zero values are replaced
+// by the defaults.
+type Options struct {
+	Logger         *Logger
+	Clock          Clock
+	NewOpampClient opamp.ClientFactory
+	// Metrics of the agent, kept by the meta agent across restarts of the supervisor.
+	Metrics *metrics.Agent
+	// Where the supervisors publish what happens to their agent, nil to publish nothing.
+	Events *events.Bus
+}
+
+// Configurable is implemented by the supervisors that use the services of the meta agent.
+// Configure is called before Setup.
+type Configurable interface {
+	Configure(options Options)
+}
@@ -0,0 +1,99 @@
+package supervisor
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PrivateFilePerm are the permissions of the files of the data directory. Effective configs can contain secrets.
+const PrivateFilePerm os.FileMode = 0600
+
+// ErrChecksumMismatch is returned by ReadFile when a file does not match its checksum.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+func checksumPath(path string) string {
+	return path + ".sha256"
+}
+
+func checksum(content []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(content))
+}
+
+// WriteFile replaces the file at path with content, so that after a crash the file is either the old one
+// or the new one, never a mix. The checksum of content is kept next to the file, for ReadFile.
+func WriteFile(path string, content []byte, perm os.FileMode) error {
+	// Without its checksum, the old file is still accepted if the new one does not make it to the disk.
+	if err := os.Remove(checksumPath(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := writeAtomically(path, content, perm); err != nil {
+		return err
+	}
+	return writeAtomically(checksumPath(path), []byte(checksum(content)), perm)
+}
+
+// ReadFile reads a file written by WriteFile, and checks it against its checksum. The files without
+// a checksum, written by older versions, are accepted as they are.
+func ReadFile(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	expected, err := os.ReadFile(checksumPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return content, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(string(expected)) != checksum(content) {
+		return nil, fmt.Errorf("%s: %w", path, ErrChecksumMismatch)
+	}
+	return content, nil
+}
+
+// writeAtomically writes content to a temporary file of the same directory, flushes it to the disk,
+// then renames it to path.
+func writeAtomically(path string, content []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	err = func() error {
+		defer f.Close()
+		if err := f.Chmod(perm); err != nil {
+			return err
+		}
+		if _, err := f.Write(content); err != nil {
+			return err
+		}
+		return f.Sync()
+	}()
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir flushes the entries of dir, so a rename survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package supervisor
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "effective.yaml")
+	assert.Nil(t, os.WriteFile(path, []byte("old"), 0644))
+
+	assert.Nil(t, WriteFile(path, []byte("receivers: {}\n"), PrivateFilePerm))
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, PrivateFilePerm, info.Mode().Perm())
+	content, err := ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "receivers: {}\n", string(content))
+
+	// Only the file and its checksum are left.
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+}
+
+func TestReadFileChecksum(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ulid")
+	// Written by an older version, without checksum.
+	assert.Nil(t, os.WriteFile(path, []byte("legacy"), 0644))
+	content, err := ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "legacy", string(content))
+
+	assert.Nil(t, WriteFile(path, []byte("new"), PrivateFilePerm))
+	assert.Nil(t, os.WriteFile(path, []byte("nex"), PrivateFilePerm))
+	_, err = ReadFile(path)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
+}
+
+func TestLockDir(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := LockDir(dir)
+	assert.Nil(t, err)
+
+	_, err = LockDir(dir)
+	assert.ErrorIs(t, err, ErrDirLocked)
+
+	assert.Nil(t, lock.Unlock())
+	lock, err = LockDir(dir)
+	assert.Nil(t, err)
+	assert.Nil(t, lock.Unlock())
+}
@@ -0,0 +1,160 @@
+package supervisor
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+type RestartMode string
+
+const (
+	RestartAlways    RestartMode = "always"
+	RestartOnFailure RestartMode = "on-failure"
+	RestartNever     RestartMode = "never"
+)
+
+// State of an agent process as seen by its supervisor.
+type State string
+
+const (
+	StateStopped State = "stopped"
+	StateRunning State = "running"
+	// The supervisor runs, but the agent process waits for a config from the OpAMP server. The agent is not
+	// healthy meanwhile.
+	StateWaitingForConfig State = "waiting-for-config"
+	StateBackoff          State = "backoff"
+	StateCrashLooping     State = "crash-looping"
+	// The agent could not be started, and the others run without it.
+	StateDegraded State = "degraded"
+)
+
+// RestartPolicy tells a supervisor when and how fast to restart an agent process that exited.
+type RestartPolicy struct {
+	Mode           RestartMode
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Fraction of the backoff that is randomly added or removed, between 0 and 1.
+	Jitter float64
+	// The agent is considered crash-looping once it is restarted MaxRestarts times within Window.
+	// Zero disables the detection.
+	MaxRestarts int
+	Window      time.Duration
+}
+
+func DefaultRestartPolicy() RestartPolicy {
+	return RestartPolicy{
+		Mode:           RestartAlways,
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Minute,
+		Jitter:         0.2,
+		MaxRestarts:    10,
+		Window:         10 * time.Minute,
+	}
+}
+
+func ParseRestartMode(mode string) (RestartMode, error) {
+	switch RestartMode(mode) {
+	case RestartAlways, RestartOnFailure, RestartNever:
+		return RestartMode(mode), nil
+	}
+	return "", fmt.Errorf("Unknown restart mode '%s'", mode)
+}
+
+// RestartTracker keeps the restart history of an agent process and computes the backoff
+// before the next restart.
+type RestartTracker struct {
+	mu      sync.Mutex
+	policy  RestartPolicy
+	recent  []time.Time
+	total   int
+	backoff time.Duration
+	rand    *rand.Rand
+}
+
+func NewRestartTracker(policy RestartPolicy) *RestartTracker {
+	return &RestartTracker{
+		policy: policy,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// ShouldRestart tells whether the policy asks for a restart after the process exited with exitCode.
+func (t *RestartTracker) ShouldRestart(exitCode int) bool {
+	switch t.policy.Mode {
+	case RestartNever:
+		return false
+	case RestartOnFailure:
+		return exitCode != 0
+	default:
+		return true
+	}
+}
+
+// Next records a restart at now and returns how long to wait before it.
+// It returns false when the crash-loop threshold is reached and the process should not be restarted.
+func (t *RestartTracker) Next(now time.Time) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune(now)
+	if t.policy.MaxRestarts > 0 && len(t.recent) >= t.policy.MaxRestarts {
+		return 0, false
+	}
+
+	// The backoff only grows while restarts keep happening within the window.
+	if len(t.recent) == 0 || t.backoff == 0 {
+		t.backoff = t.policy.InitialBackoff
+	} else {
+		t.backoff *= 2
+	}
+	if t.policy.MaxBackoff > 0 && t.backoff > t.policy.MaxBackoff {
+		t.backoff = t.policy.MaxBackoff
+	}
+
+	t.recent = append(t.recent, now)
+	t.total++
+	return t.withJitter(t.backoff), true
+}
+
+// Reset forgets the recent restarts, for example after a new config was applied.
+func (t *RestartTracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.recent = nil
+	t.backoff = 0
+}
+
+// Restarts returns the number of restarts since the tracker was created.
+func (t *RestartTracker) Restarts() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.total
+}
+
+// RecentRestarts returns the number of restarts within the crash-loop window.
+func (t *RestartTracker) RecentRestarts(now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune(now)
+	return len(t.recent)
+}
+
+func (t *RestartTracker) prune(now time.Time) {
+	if t.policy.Window <= 0 {
+		return
+	}
+	i := 0
+	for i < len(t.recent) && now.Sub(t.recent[i]) >= t.policy.Window {
+		i++
+	}
+	t.recent = t.recent[i:]
+}
+
+func (t *RestartTracker) withJitter(d time.Duration) time.Duration {
+	if t.policy.Jitter <= 0 || d <= 0 {
+		return d
+	}
+	delta := (t.rand.Float64()*2 - 1) * t.policy.Jitter * float64(d)
+	return d + time.Duration(delta)
+}
@@ -0,0 +1,57 @@
+package supervisor
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRestartBackoff(t *testing.T) {
+	tracker := NewRestartTracker(RestartPolicy{
+		Mode:           RestartAlways,
+		InitialBackoff: time.Second,
+		MaxBackoff:     4 * time.Second,
+		Window:         time.Minute,
+	})
+	now := time.Now()
+
+	var delays []time.Duration
+	for i := 0; i < 4; i++ {
+		delay, ok := tracker.Next(now)
+		assert.True(t, ok)
+		delays = append(delays, delay)
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second}, delays)
+
+	// Once the window has passed without restarts the backoff starts over.
+	delay, ok := tracker.Next(now.Add(2 * time.Minute))
+	assert.True(t, ok)
+	assert.Equal(t, time.Second, delay)
+	assert.Equal(t, 5, tracker.Restarts())
+}
+
+func TestRestartCrashLoop(t *testing.T) {
+	tracker := NewRestartTracker(RestartPolicy{
+		Mode:           RestartAlways,
+		InitialBackoff: time.Second,
+		MaxRestarts:    3,
+		Window:         time.Minute,
+	})
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		_, ok := tracker.Next(now.Add(time.Duration(i) * time.Second))
+		assert.True(t, ok)
+	}
+	_, ok := tracker.Next(now.Add(3 * time.Second))
+	assert.False(t, ok)
+	assert.Equal(t, 3, tracker.RecentRestarts(now.Add(3*time.Second)))
+	assert.Equal(t, 3, tracker.Restarts())
+}
+
+func TestRestartMode(t *testing.T) {
+	assert.True(t, NewRestartTracker(RestartPolicy{Mode: RestartAlways}).ShouldRestart(0))
+	assert.False(t, NewRestartTracker(RestartPolicy{Mode: RestartOnFailure}).ShouldRestart(0))
+	assert.True(t, NewRestartTracker(RestartPolicy{Mode: RestartOnFailure}).ShouldRestart(1))
+	assert.False(t, NewRestartTracker(RestartPolicy{Mode: RestartNever}).ShouldRestart(1))
+}
@@ -1,41 +1,52 @@
 package supervisor
 
 import (
-	"errors"
-	"github.com/oklog/ulid/v2"
-	"math/rand"
-	"os"
-	"path/filepath"
-	"strings"
+	"context"
 	"time"
 )
 
 type Supervisor interface {
 	Start() error
-	Stop() error
+	// Stop stops the agent. The agent is killed if it is still running when ctx is done.
+	Stop(ctx context.Context) error
 	Setup() error
+	// Restart stops the agent process and starts it again, even if the supervisor gave up on it.
+	// The supervisor must be started. The agent is killed if it is still running when ctx is done.
+	Restart(ctx context.Context) error
+	Health() Health
+	Status() Status
 }
 
-func GetOrCreateInstanceId(dir string) (ulid.ULID, error) {
-	var ulidFileName = filepath.Join(dir, "ulid")
-	var instanceId ulid.ULID
-	if _, err := os.Stat(ulidFileName); err == nil {
-		f, err := os.ReadFile(ulidFileName)
-		if err != nil {
-			panic(err)
-		}
-		rawUlid := strings.TrimSuffix(string(f), "\n")
-		instanceId, err = ulid.Parse(rawUlid)
-		return ulid.Parse(rawUlid)
-	} else if errors.Is(err, os.ErrNotExist) {
-		// Generate instance id.
-		entropy := ulid.Monotonic(rand.New(rand.NewSource(0)), 0)
-		instanceId, err := ulid.New(ulid.Timestamp(time.Now()), entropy)
-		if err != nil {
-			return instanceId, err
-		}
-		err = os.WriteFile(ulidFileName, []byte(instanceId.String()), 0644)
-		return instanceId, err
-	}
-	return instanceId, nil
+// Health of an agent as seen by its supervisor.
+type Health struct {
+	Healthy   bool
+	State     State
+	LastError string
+	// When the agent process was started, zero if it is not running.
+	StartTime time.Time
+}
+
+// Status is the health of an agent along with the details of its process.
+type Status struct {
+	Health
+	// PID of the agent process, zero if it was never started.
+	Pid          int
+	Restarts     int
+	LastExitCode int
+	// State of the connection to the OpAMP server, empty for the agents without one.
+	OpampConnection ConnectionState
+	// Hash of the last remote config applied, empty if none was.
+	ConfigHash string
+}
+
+type ConnectionState string
+
+const (
+	Connected    ConnectionState = "connected"
+	Disconnected ConnectionState = "disconnected"
+)
+
+// EffectiveConfigReporter is implemented by the supervisors of the agents configured remotely.
+type EffectiveConfigReporter interface {
+	GetEffectiveConfig() string
 }
@@ -1,6 +1,9 @@
 package supervisor
 
 import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/oklog/ulid/v2"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"path/filepath"
@@ -30,13 +33,25 @@ func teardown() {
 }
 
 func TestGetUlid(t *testing.T) {
-	instanceId, err := GetOrCreateInstanceId("testdata")
+	// The id file of the older versions, without the host.
+	dir := t.TempDir()
+	legacy, err := os.ReadFile(filepath.Join("testdata", "ulid"))
 	assert.Nil(t, err)
-	assert.Equal(t, instanceId.String(), "01GTEVKE9Q06AFVGQT5ZYC0GEK")
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "ulid"), legacy, 0644))
+
+	instanceId, err := GetOrCreateInstanceId(dir, "host-a", ulid.ULID{})
+	assert.Nil(t, err)
+	assert.Equal(t, instanceId.Id.String(), "01GTEVKE9Q06AFVGQT5ZYC0GEK")
+	assert.Zero(t, instanceId.Replaced)
+
+	// The id is bound to the host that first read it.
+	instanceId, err = GetOrCreateInstanceId(dir, "host-b", ulid.ULID{})
+	assert.Nil(t, err)
+	assert.NotEqual(t, instanceId.Id.String(), "01GTEVKE9Q06AFVGQT5ZYC0GEK")
 }
 
 func TestCreateUlid(t *testing.T) {
-	instanceId, err := GetOrCreateInstanceId("testdata/generated")
+	instanceId, err := GetOrCreateInstanceId("testdata/generated", "host-a", ulid.ULID{})
 	assert.Nil(t, err)
 
 	var ulidFileName = filepath.Join("testdata", "generated", "ulid")
@@ -46,5 +61,71 @@ func TestCreateUlid(t *testing.T) {
 	f, err := os.ReadFile(ulidFileName)
 	assert.Nil(t, err)
 	rawUlid := strings.TrimSuffix(string(f), "\n")
-	assert.Equal(t, instanceId.String(), rawUlid)
+	assert.Equal(t, instanceId.Id.String(), rawUlid)
+}
+
+func TestUlidsDiffer(t *testing.T) {
+	// Ids created at the same millisecond must not collide.
+	first, err := GetOrCreateInstanceId(t.TempDir(), "host-a", ulid.ULID{})
+	assert.Nil(t, err)
+	second, err := GetOrCreateInstanceId(t.TempDir(), "host-b", ulid.ULID{})
+	assert.Nil(t, err)
+	assert.NotEqual(t, first.Id, second.Id)
+}
+
+func TestClonedUlid(t *testing.T) {
+	dir := t.TempDir()
+	original, err := GetOrCreateInstanceId(dir, "host-a", ulid.ULID{})
+	assert.Nil(t, err)
+	again, err := GetOrCreateInstanceId(dir, "host-a", ulid.ULID{})
+	assert.Nil(t, err)
+	assert.Equal(t, original, again)
+
+	clone, err := GetOrCreateInstanceId(dir, "host-b", ulid.ULID{})
+	assert.Nil(t, err)
+	assert.NotEqual(t, original.Id, clone.Id)
+	assert.Equal(t, original.Id, clone.Replaced)
+	again, err = GetOrCreateInstanceId(dir, "host-b", ulid.ULID{})
+	assert.Nil(t, err)
+	assert.Equal(t, InstanceId{Id: clone.Id}, again)
+}
+
+func TestPinnedUlid(t *testing.T) {
+	dir := t.TempDir()
+	pinned := ulid.MustParse("01GTEVKE9Q06AFVGQT5ZYC0GEK")
+	_, err := GetOrCreateInstanceId(dir, "host-a", ulid.ULID{})
+	assert.Nil(t, err)
+
+	instanceId, err := GetOrCreateInstanceId(dir, "host-b", pinned)
+	assert.Nil(t, err)
+	assert.Equal(t, InstanceId{Id: pinned}, instanceId)
+	instanceId, err = GetOrCreateInstanceId(dir, "host-b", ulid.ULID{})
+	assert.Nil(t, err)
+	assert.Equal(t, InstanceId{Id: pinned}, instanceId)
+}
+
+func TestInvalidUlid(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "ulid"), []byte("not an id"), 0644))
+	_, err := GetOrCreateInstanceId(dir, "host-a", ulid.ULID{})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid instance id")
+}
+
+func TestHostFingerprint(t *testing.T) {
+	defer func(paths []string) { machineIdPaths = paths }(machineIdPaths)
+	dir := t.TempDir()
+	machineId := filepath.Join(dir, "machine-id")
+	machineIdPaths = []string{filepath.Join(dir, "missing"), machineId}
+
+	// Without a machine id, as in most containers, the hostname identifies the host.
+	hostname, err := os.Hostname()
+	assert.Nil(t, err)
+	byHostname := HostFingerprint()
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("hostname:"+hostname))), byHostname)
+
+	// The machine id alone identifies the host when there is one, so the host can be renamed.
+	assert.Nil(t, os.WriteFile(machineId, []byte("0123456789abcdef\n"), 0644))
+	assert.Equal(t, fmt.Sprintf("%x", sha256.Sum256([]byte("machine-id:0123456789abcdef"))), HostFingerprint())
+	assert.NotEqual(t, byHostname, HostFingerprint())
 }